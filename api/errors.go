@@ -0,0 +1,32 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors wrapped by query failures, meant to be checked with `errors.Is`.
+var (
+	ErrTimeout            = errors.New("timed out")                    // The game server didn't answer in time
+	ErrConnectionRefused  = errors.New("connection refused")           // The game server actively refused the connection (e.g. it's offline)
+	ErrMalformedResponse  = errors.New("malformed response")           // The game server answered with something that couldn't be parsed
+	ErrUnsupportedFeature = errors.New("unsupported protocol feature") // The game server answered using a protocol feature that isn't supported
+	ErrUnknownProtocol    = errors.New("unknown protocol")             // No protocol matches the requested game
+)
+
+// Returned when a decompressed response doesn't match the size or CRC32 checksum announced by the game server.
+// Matches ErrMalformedResponse with `errors.Is`.
+type ChecksumError struct {
+	Size           uint32 // The announced size
+	ActualSize     uint32
+	Checksum       uint32 // The announced checksum
+	ActualChecksum uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("malformed response: decompressed response doesn't match its checksum (size %d, expected %d; crc32 %08x, expected %08x)", e.ActualSize, e.Size, e.ActualChecksum, e.Checksum)
+}
+
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrMalformedResponse
+}
@@ -4,10 +4,45 @@ import "time"
 
 // Representation of a query request for a specific game server.
 type Request struct {
-	Game    string         // The game protocol to use, can be left out for the `Detect` function.
-	IP      string         // The game server's query IP
-	Port    uint16         // The game server's query port
-	Timeout *time.Duration // Timeout for a single send/receive operation in the game's protocol.
+	Game    string         // The game protocol (or catalog game ID) to use, can be left out for the `Detect` function.
+	IP      string         // The game server's query IP or hostname
+	Port    uint16         // The game server's query port (game port for catalog games), the default (or its SRV record for hostnames) if left out
+	Timeout *time.Duration // Timeout for a single send/receive operation in the game's protocol, the client's if left out (0 disables it).
+
+	TotalTimeout *time.Duration // Timeout for the whole query, including connecting, every round trip and retry.
+
+	Ports           []uint16 // Candidate query ports to try in parallel, overriding Port
+	ScanPortOffsets bool     // Also tries the common query port offsets (+1, +2, +10, +123) from Port, when Ports is empty
+
+	Network   string // Address family to use, "ip4" or "ip6" (empty prefers the resolver's order and falls back to the other family)
+	LocalAddr string // Local IP to send the query from, overriding the client's (only applies to the default dialer)
+
+	// Amount of round trips to measure the ping over, values below 2 measure a single one. Only honored by the
+	// UDP protocols (source, minecraft_udp), the Minecraft server closes the TCP connection after a single ping.
+	PingSamples int
+	Rules       bool         // Also requests the server's rules (e.g. Source cvars), which protocols supporting them return in Raw.
+	Retry       *RetryPolicy // Overrides the client's retry policy for this request.
+}
+
+// Policy for retrying failed queries. UDP protocols retransmit each of their request/response exchanges
+// which timed out, while TCP protocols retry the whole query after any failure.
+type RetryPolicy struct {
+	Attempts   int           // Total amount of attempts, values below 1 mean a single attempt
+	Backoff    time.Duration // Delay before the first retry
+	Multiplier float64       // Factor the delay grows by after each retry, values below 1 keep it constant
+	MaxBackoff time.Duration // Upper bound of the delay, 0 means no bound
+	Jitter     float64       // Randomizes the delay by up to this fraction of it (e.g. 0.2 for +-20%)
+}
+
+// Entry of the built-in game catalog
+type Game struct {
+	ID              string // Identifier to use as Request.Game
+	Name            string // Display name of the game
+	Protocol        string // The query protocol (name or alias) the game speaks
+	GamePort        uint16 // The game's default port
+	QueryPortOffset int    // Offset of the query port from the game port
+	QueryPort       uint16 // Fixed query port regardless of the game port, 0 if it's derived with QueryPortOffset
+	SteamAppID      uint32 // The game's Steam AppID, 0 if it isn't a Steam game
 }
 
 // Player information of the server
@@ -15,16 +50,51 @@ type PlayersResponse struct {
 	Current int      // The amount of players currently on the server
 	Max     int      // The amount of players the server can hold
 	Names   []string // List of player names on the server, could be partial (so that the length of Names =/= Current)
+	List    []Player // Same players as in Names, with all of the information the protocol provides about them
 }
 
-// Representation of a query result for a specific game server. All of the fields are guaranteed to be present (other than the contents of Raw).
+// A single player on the server, fields not provided by the game's protocol are left empty.
+type Player struct {
+	Name     string
+	Score    int
+	Duration time.Duration // How long the player has been connected
+	ID       string        // Unique player ID (e.g. Minecraft UUID)
+	IsBot    bool          // Whether the protocol identified the player as a bot, none of the built-in ones do (see Response.Bots)
+}
+
+// Representation of a query result for a specific game server. Name and Players are guaranteed to be present,
+// the other normalized fields are left empty when the game's protocol doesn't provide them.
 type Response struct {
 	Name    string          // The server name
 	Players PlayersResponse // Player information of the server
 
+	Map        string   // The current map
+	Version    string   // The server's game version
+	GameType   string   // The game or game mode the server is running
+	Passworded bool     // Whether joining the server requires a password
+	Bots       int      // The amount of bots on the server
+	Secure     bool     // Whether the server uses an anti-cheat (e.g. VAC)
+	ServerOS   string   // The server's operating system, one of "linux", "windows" or "mac"
+	Tags       []string // Tags/keywords the server advertises
+
+	Address string // The address (IP:port) which answered the query
+	Port    uint16 // The port which answered the query, useful when multiple candidate ports were tried
+	Network string // Address family of the address, either "ip4" or "ip6"
+
+	Ping      time.Duration // Round trip latency to the server (average of the samples when Request.PingSamples > 1)
+	PingStats *PingStats    // Latency statistics, only present when multiple samples were measured
+
 	Raw interface{} // Contains the original, raw response received from the game's protocol.
 }
 
+// Round trip latency statistics over multiple samples
+type PingStats struct {
+	Samples int
+	Min     time.Duration
+	Avg     time.Duration
+	Max     time.Duration
+}
+
 // Raw Minecraft UDP response
 type MinecraftUDPRaw struct {
 	Hostname   string
@@ -60,6 +130,13 @@ type MinecraftTCPRaw struct {
 	Favicon string
 }
 
+// Raw Source Query response
+type SourceQueryRaw struct {
+	Info    SourceQuery_A2SInfo
+	Players []SourceQuery_A2SPlayer // A2S_PLAYER response, empty if the server didn't answer it
+	Rules   map[string]string       // A2S_RULES response, only present when requested with Request.Rules
+}
+
 // Optional extra data included in SourceQuery A2S info response
 type SourceQuery_ExtraData struct {
 	Port         uint16
@@ -86,7 +163,10 @@ type SourceQuery_A2SInfo struct {
 	Visibility  uint8
 	VAC         uint8
 
-	// The Ship
+	// The Ship only
+	Mode      uint8 // Game mode (0 Hunt, 1 Elimination, 2 Duel, 3 Deathmatch, 4 VIP Team, 5 Team Elimination)
+	Witnesses uint8 // Amount of witnesses required for a player to be arrested
+	Duration  uint8 // Time (in seconds) before a player is arrested while being witnessed
 
 	Version   string
 	EDF       uint8
@@ -99,4 +179,8 @@ type SourceQuery_A2SPlayer struct {
 	Name     string
 	Score    int32
 	Duration float32
+
+	// The Ship only
+	Deaths int32
+	Money  int32
 }
@@ -0,0 +1,133 @@
+package gamequery
+
+import (
+	"context"
+	"github.com/wisp-gg/gamequery/api"
+	"sync"
+	"time"
+)
+
+const defaultBulkConcurrency = 64
+
+// Options for querying many game servers at once.
+type BulkOptions struct {
+	Concurrency     int                   // Maximum amount of requests being queried at the same time, defaults to 64
+	PerHostInterval time.Duration         // Minimum delay between starting two queries to the same IP, 0 disables the rate limit
+	Progress        func(done, total int) // Called (never concurrently) after each finished request
+}
+
+// Result of a single request queried by `QueryMany`.
+type BulkResult struct {
+	Index    int         // Index of the request in the slice passed to QueryMany
+	Request  api.Request // The request itself
+	Response api.Response
+	Protocol string // The protocol which answered
+	Err      error
+}
+
+// Query many game servers concurrently, using the default client. See `Client.QueryMany` for more details.
+func QueryMany(ctx context.Context, reqs []api.Request, opts BulkOptions) <-chan BulkResult {
+	return defaultClient.QueryMany(ctx, reqs, opts)
+}
+
+// Query many game servers concurrently, streaming the results (in completion order) over the returned channel,
+// which is closed after the last result. Requests with an empty Game detect the protocol like `Detect` does.
+// Once ctx is done the remaining results are dropped, otherwise the channel has to be drained.
+func (c *Client) QueryMany(ctx context.Context, reqs []api.Request, opts BulkOptions) <-chan BulkResult {
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = defaultBulkConcurrency
+	}
+
+	results := make(chan BulkResult, concurrency)
+	limiter := make(chan struct{}, concurrency)
+	hosts := hostLimiter{
+		interval: opts.PerHostInterval,
+		next:     make(map[string]time.Time),
+	}
+
+	var progressMutex sync.Mutex
+	var done = 0
+
+	var wg sync.WaitGroup
+	wg.Add(len(reqs))
+	for index, req := range reqs {
+		go func(index int, req api.Request) {
+			defer wg.Done()
+
+			result := BulkResult{
+				Index:   index,
+				Request: req,
+			}
+
+			if result.Err = hosts.wait(ctx, req.IP); result.Err == nil {
+				select {
+				case limiter <- struct{}{}:
+					result.Response, result.Protocol, result.Err = c.queryBulkRequest(ctx, req)
+					<-limiter
+				case <-ctx.Done():
+					result.Err = ctx.Err()
+				}
+			}
+
+			if opts.Progress != nil {
+				progressMutex.Lock()
+				done++
+				opts.Progress(done, len(reqs))
+				progressMutex.Unlock()
+			}
+
+			select {
+			case results <- result:
+			case <-ctx.Done():
+			}
+		}(index, req)
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
+
+func (c *Client) queryBulkRequest(ctx context.Context, req api.Request) (api.Response, string, error) {
+	if req.Game == "" {
+		return c.DetectContext(ctx, req)
+	}
+
+	return c.queryGame(ctx, req)
+}
+
+// Spaces out the queries to the same host by reserving consecutive time slots for them.
+type hostLimiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	next     map[string]time.Time
+}
+
+func (limiter *hostLimiter) wait(ctx context.Context, host string) error {
+	if limiter.interval <= 0 {
+		return nil
+	}
+
+	limiter.mutex.Lock()
+	now := time.Now()
+	slot := limiter.next[host]
+	if slot.Before(now) {
+		slot = now
+	}
+	limiter.next[host] = slot.Add(limiter.interval)
+	limiter.mutex.Unlock()
+
+	timer := time.NewTimer(slot.Sub(now))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,100 @@
+package gamequery
+
+import (
+	"fmt"
+	"github.com/wisp-gg/gamequery/api"
+	"github.com/wisp-gg/gamequery/protocol"
+	"sort"
+)
+
+var games = []api.Game{
+	{ID: "7d2d", Name: "7 Days to Die", Protocol: "source", GamePort: 26900, QueryPortOffset: 0, SteamAppID: 251570},
+	{ID: "ark", Name: "ARK: Survival Evolved", Protocol: "source", GamePort: 7777, QueryPort: 27015, SteamAppID: 346110},
+	{ID: "arma3", Name: "Arma 3", Protocol: "source", GamePort: 2302, QueryPortOffset: 1, SteamAppID: 107410},
+	{ID: "conanexiles", Name: "Conan Exiles", Protocol: "source", GamePort: 7777, QueryPort: 27015, SteamAppID: 440900},
+	{ID: "cs16", Name: "Counter-Strike 1.6", Protocol: "source", GamePort: 27015, QueryPortOffset: 0, SteamAppID: 10},
+	{ID: "cs2", Name: "Counter-Strike 2", Protocol: "source", GamePort: 27015, QueryPortOffset: 0, SteamAppID: 730},
+	{ID: "csgo", Name: "Counter-Strike: Global Offensive", Protocol: "source", GamePort: 27015, QueryPortOffset: 0, SteamAppID: 730},
+	{ID: "css", Name: "Counter-Strike: Source", Protocol: "source", GamePort: 27015, QueryPortOffset: 0, SteamAppID: 240},
+	{ID: "dods", Name: "Day of Defeat: Source", Protocol: "source", GamePort: 27015, QueryPortOffset: 0, SteamAppID: 300},
+	{ID: "gmod", Name: "Garry's Mod", Protocol: "source", GamePort: 27015, QueryPortOffset: 0, SteamAppID: 4000},
+	{ID: "hl2dm", Name: "Half-Life 2: Deathmatch", Protocol: "source", GamePort: 27015, QueryPortOffset: 0, SteamAppID: 320},
+	{ID: "insurgency", Name: "Insurgency", Protocol: "source", GamePort: 27015, QueryPortOffset: 0, SteamAppID: 222880},
+	{ID: "insurgencysandstorm", Name: "Insurgency: Sandstorm", Protocol: "source", GamePort: 27102, QueryPortOffset: 29, SteamAppID: 581320},
+	{ID: "killingfloor2", Name: "Killing Floor 2", Protocol: "source", GamePort: 7777, QueryPort: 27015, SteamAppID: 232090},
+	{ID: "l4d2", Name: "Left 4 Dead 2", Protocol: "source", GamePort: 27015, QueryPortOffset: 0, SteamAppID: 550},
+	{ID: "minecraft", Name: "Minecraft: Java Edition", Protocol: "minecraft", GamePort: 25565, QueryPortOffset: 0},
+	{ID: "projectzomboid", Name: "Project Zomboid", Protocol: "source", GamePort: 16261, QueryPortOffset: 0, SteamAppID: 108600},
+	{ID: "rust", Name: "Rust", Protocol: "source", GamePort: 28015, QueryPortOffset: 1, SteamAppID: 252490},
+	{ID: "spaceengineers", Name: "Space Engineers", Protocol: "source", GamePort: 27016, QueryPortOffset: 0, SteamAppID: 244850},
+	{ID: "tf2", Name: "Team Fortress 2", Protocol: "source", GamePort: 27015, QueryPortOffset: 0, SteamAppID: 440},
+	{ID: "unturned", Name: "Unturned", Protocol: "source", GamePort: 27015, QueryPortOffset: 1, SteamAppID: 304930},
+	{ID: "valheim", Name: "Valheim", Protocol: "source", GamePort: 2456, QueryPortOffset: 1, SteamAppID: 892970},
+}
+
+// Returns the built-in game catalog sorted by ID, e.g. for listing the supported games in a UI.
+func Games() []api.Game {
+	list := make([]api.Game, len(games))
+	copy(list, games)
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+
+	return list
+}
+
+// Returns the catalog entry of the game with the given ID.
+func LookupGame(id string) (api.Game, bool) {
+	for _, game := range games {
+		if game.ID == id {
+			return game, true
+		}
+	}
+
+	return api.Game{}, false
+}
+
+// Returns the query port belonging to the given game port.
+func gameQueryPort(game api.Game, gamePort uint16) (uint16, error) {
+	if game.QueryPort != 0 {
+		return game.QueryPort, nil
+	}
+
+	queryPort := int(gamePort) + game.QueryPortOffset
+	if queryPort < 1 || queryPort > 0xFFFF {
+		return 0, fmt.Errorf("query port of the %s game port %d is out of range", game.ID, gamePort)
+	}
+
+	return uint16(queryPort), nil
+}
+
+// Translates a request for a catalog game (with Port being the game port) into a request for its
+// protocol and query port. The port is left out when it matches the protocols' default anyway,
+// so that SRV records still apply.
+func applyGame(req api.Request, game api.Game, chosenProtocols []protocol.Protocol) (api.Request, error) {
+	req.Game = game.Protocol
+	if req.Port != 0 {
+		queryPort, err := gameQueryPort(game, req.Port)
+		if err != nil {
+			return req, err
+		}
+
+		req.Port = queryPort
+		return req, nil
+	}
+
+	queryPort, err := gameQueryPort(game, game.GamePort)
+	if err != nil {
+		return req, err
+	}
+
+	for _, queryProtocol := range chosenProtocols {
+		if queryProtocol.DefaultPort() != queryPort {
+			req.Port = queryPort
+			break
+		}
+	}
+
+	return req, nil
+}
@@ -0,0 +1,280 @@
+package gamequery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/wisp-gg/gamequery/api"
+	"github.com/wisp-gg/gamequery/internal"
+	"github.com/wisp-gg/gamequery/protocol"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultTimeout = 5 * time.Second
+
+// Establishes the connections to the game servers, e.g. a proxy's dialer (see protocol.Dialer).
+type Dialer = protocol.Dialer
+
+// Receives the library's diagnostic messages, *slog.Logger satisfies this interface.
+type Logger = protocol.Logger
+
+// Reusable query client, holding the configuration shared by all of its queries.
+// A Client is safe for concurrent use by multiple goroutines.
+type Client struct {
+	timeout   time.Duration
+	retry     api.RetryPolicy
+	dialer    Dialer // nil for the default dialer, which is bound according to bind
+	bind      internal.BindDialer
+	resolver  Resolver
+	logger    Logger
+	protocols []protocol.Protocol
+	limiter   chan struct{}
+
+	muxSockets int
+	muxMutex   sync.Mutex
+	mux        *internal.UDPMux // Created on the first UDP query
+	closed     bool
+}
+
+var errClientClosed = errors.New("gamequery: client is closed")
+
+// Configures a Client created by NewClient.
+type Option func(*Client)
+
+// Sets the default timeout for a single send/receive operation, used when the request doesn't specify one.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// Sets the policy for retrying failed protocol queries.
+func WithRetryPolicy(policy api.RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = policy
+	}
+}
+
+// Sets the dialer used to connect to the game servers.
+func WithDialer(dialer Dialer) Option {
+	return func(c *Client) {
+		c.dialer = dialer
+	}
+}
+
+// Makes the queries originate from the given local IP, for both TCP and UDP protocols.
+// Applies to the default dialer and the shared UDP sockets, custom dialers have to be bound by themselves.
+func WithLocalAddr(ip net.IP) Option {
+	return func(c *Client) {
+		c.bind.IP = ip
+	}
+}
+
+// Makes the queries originate from a local port within the given (inclusive) range.
+// Like WithLocalAddr, it only applies to the default dialer and the shared UDP sockets.
+func WithLocalPortRange(minPort, maxPort uint16) Option {
+	return func(c *Client) {
+		c.bind.MinPort = minPort
+		c.bind.MaxPort = maxPort
+	}
+}
+
+// Sets the resolver used for the requests' hostnames (including SRV records).
+func WithResolver(resolver Resolver) Option {
+	return func(c *Client) {
+		c.resolver = resolver
+	}
+}
+
+// Sets the logger receiving the client's diagnostic messages.
+func WithLogger(logger Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// Restricts the client to the given protocols (by name or alias), both for `Query` and `Detect`.
+// Names not matching any protocol are ignored, if none match the queries fail with api.ErrUnknownProtocol.
+func WithProtocols(names ...string) Option {
+	return func(c *Client) {
+		c.protocols = make([]protocol.Protocol, 0)
+		for _, name := range names {
+			for _, queryProtocol := range findProtocols(registeredProtocols(), name) {
+				if !containsProtocol(c.protocols, queryProtocol) {
+					c.protocols = append(c.protocols, queryProtocol)
+				}
+			}
+		}
+	}
+}
+
+// Limits the amount of protocol queries the client runs at the same time, 0 means no limit.
+func WithConcurrency(limit int) Option {
+	return func(c *Client) {
+		c.limiter = nil
+		if limit > 0 {
+			c.limiter = make(chan struct{}, limit)
+		}
+	}
+}
+
+// Makes UDP queries share the given amount of sockets instead of each query opening its own socket,
+// which avoids exhausting ephemeral ports and file descriptors when querying many servers.
+// `Close` has to be called to release them. Has no effect together with `WithDialer`, as the queries
+// have to go through the custom dialer (e.g. a proxy).
+func WithSharedUDP(sockets int) Option {
+	return func(c *Client) {
+		c.muxSockets = sockets
+	}
+}
+
+// Creates a new Client, any option not provided falls back to the package defaults.
+func NewClient(options ...Option) *Client {
+	c := &Client{
+		timeout:  defaultTimeout,
+		resolver: net.DefaultResolver,
+		logger:   protocol.NopLogger{},
+	}
+
+	for _, option := range options {
+		option(c)
+	}
+
+	return c
+}
+
+// Releases the client's shared UDP sockets, the client can't be used for querying afterwards.
+func (c *Client) Close() error {
+	c.muxMutex.Lock()
+	defer c.muxMutex.Unlock()
+
+	c.closed = true
+	if c.mux != nil {
+		return c.mux.Close()
+	}
+
+	return nil
+}
+
+// Returns the shared UDP sockets, opening them if needed. Failing to open them isn't remembered,
+// so that a temporary failure (e.g. an exhausted port range) doesn't break the client for good.
+func (c *Client) udpMux() (*internal.UDPMux, error) {
+	c.muxMutex.Lock()
+	defer c.muxMutex.Unlock()
+
+	if c.closed {
+		return nil, errClientClosed
+	}
+
+	if c.mux == nil {
+		mux, err := internal.NewUDPMux(c.muxSockets, c.bind, c.logger)
+		if err != nil {
+			return nil, err
+		}
+
+		c.mux = mux
+	}
+
+	return c.mux, nil
+}
+
+// Returns the dialer to use for the protocol's connections.
+func (c *Client) protocolDialer(req api.Request, queryProtocol protocol.Protocol) (protocol.Dialer, error) {
+	bind := c.bind
+	if req.LocalAddr != "" {
+		bind.IP = net.ParseIP(req.LocalAddr)
+		if bind.IP == nil {
+			return nil, fmt.Errorf("invalid local address %q", req.LocalAddr)
+		}
+	}
+
+	// A custom dialer always takes precedence, as bypassing it (e.g. a proxy) could leak the queries.
+	if c.dialer != nil {
+		return c.dialer, nil
+	}
+
+	// The shared sockets are bound to the client's address, so requests with their own address get a dedicated socket.
+	if queryProtocol.Network() == "udp" && c.muxSockets > 0 && req.LocalAddr == "" {
+		mux, err := c.udpMux()
+		if err != nil {
+			return nil, err
+		}
+
+		var matcher internal.ResponseMatcher
+		if responseMatcher, ok := queryProtocol.(protocol.ResponseMatcher); ok {
+			matcher = responseMatcher.MatchResponse
+		}
+
+		return mux.Dialer(queryProtocol.Name(), matcher), nil
+	}
+
+	return bind, nil
+}
+
+func (c *Client) enabledProtocols() []protocol.Protocol {
+	if c.protocols != nil {
+		return c.protocols
+	}
+
+	return registeredProtocols()
+}
+
+func (c *Client) acquire(ctx context.Context) error {
+	if c.limiter == nil {
+		return nil
+	}
+
+	select {
+	case c.limiter <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) release() {
+	if c.limiter != nil {
+		<-c.limiter
+	}
+}
+
+// Query the game server by detecting the protocol (trying all of the client's protocols).
+// See the package level `Detect` function for more details.
+func (c *Client) Detect(req api.Request) (api.Response, string, error) {
+	return c.DetectContext(context.Background(), req)
+}
+
+// Same as `Detect`, but aborts all of the in-flight protocol queries as soon as ctx is done.
+func (c *Client) DetectContext(ctx context.Context, req api.Request) (api.Response, string, error) {
+	return c.query(ctx, req, c.enabledProtocols())
+}
+
+// Query the game server using the protocol (or catalog game, see `Games`) provided in req.Game.
+func (c *Client) Query(req api.Request) (api.Response, error) {
+	return c.QueryContext(context.Background(), req)
+}
+
+// Same as `Query`, but aborts the in-flight query as soon as ctx is done.
+func (c *Client) QueryContext(ctx context.Context, req api.Request) (api.Response, error) {
+	response, _, err := c.queryGame(ctx, req)
+	return response, err
+}
+
+func (c *Client) queryGame(ctx context.Context, req api.Request) (api.Response, string, error) {
+	if game, ok := LookupGame(req.Game); ok {
+		var err error
+		req, err = applyGame(req, game, findProtocols(c.enabledProtocols(), game.Protocol))
+		if err != nil {
+			return api.Response{}, "", err
+		}
+	}
+
+	chosenProtocols := findProtocols(c.enabledProtocols(), req.Game)
+	if len(chosenProtocols) < 1 {
+		return api.Response{}, "", fmt.Errorf("%w: could not find protocols for the game %q", api.ErrUnknownProtocol, req.Game)
+	}
+
+	return c.query(ctx, req, chosenProtocols)
+}
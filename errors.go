@@ -0,0 +1,65 @@
+package gamequery
+
+import (
+	"fmt"
+	"github.com/wisp-gg/gamequery/api"
+	"strings"
+	"time"
+)
+
+// Failure of a single protocol (on one of the candidate ports) while querying the game server.
+type ProtocolError struct {
+	Protocol string        // The protocol's name
+	Priority uint16        // The protocol's priority
+	Port     uint16        // The candidate port, 0 for the protocol's default
+	Elapsed  time.Duration // Time spent on the protocol's query before it failed
+	Err      error         // The underlying error
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Port != 0 {
+		return fmt.Sprintf("%s (port %d): %s (after %s)", e.Protocol, e.Port, e.Err, e.Elapsed.Round(time.Millisecond))
+	}
+
+	return fmt.Sprintf("%s: %s (after %s)", e.Protocol, e.Err, e.Elapsed.Round(time.Millisecond))
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// Returned by `Detect` and `Query` when every attempted protocol failed, containing the failure of each
+// protocol and candidate port sorted by priority (highest first). `errors.Is` and `errors.As` match any of the protocols' errors.
+type DetectError struct {
+	Protocols []*ProtocolError
+}
+
+func (e *DetectError) Error() string {
+	messages := make([]string, len(e.Protocols))
+	for index, protocolErr := range e.Protocols {
+		messages[index] = protocolErr.Error()
+	}
+
+	return "all protocols failed: " + strings.Join(messages, "; ")
+}
+
+func (e *DetectError) Unwrap() []error {
+	errs := make([]error, len(e.Protocols))
+	for index, protocolErr := range e.Protocols {
+		errs[index] = protocolErr
+	}
+
+	return errs
+}
+
+// Re-exported api sentinel errors, see the api package for their meaning.
+var (
+	ErrTimeout            = api.ErrTimeout
+	ErrConnectionRefused  = api.ErrConnectionRefused
+	ErrMalformedResponse  = api.ErrMalformedResponse
+	ErrUnsupportedFeature = api.ErrUnsupportedFeature
+	ErrUnknownProtocol    = api.ErrUnknownProtocol
+)
+
+// Re-exported api.ChecksumError, see the api package for its meaning.
+type ChecksumError = api.ChecksumError
@@ -1,30 +1,67 @@
 package gamequery
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/wisp-gg/gamequery/api"
 	"github.com/wisp-gg/gamequery/internal"
 	"github.com/wisp-gg/gamequery/internal/protocols"
+	"github.com/wisp-gg/gamequery/protocol"
+	"net"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
 
-var queryProtocols = []internal.Protocol{
-	protocols.SourceQuery{},
-	protocols.MinecraftUDP{},
-	protocols.MinecraftTCP{},
+var (
+	registryMutex  sync.RWMutex
+	queryProtocols = []protocol.Protocol{
+		protocols.SourceQuery{},
+		protocols.MinecraftUDP{},
+		protocols.MinecraftTCP{},
+	}
+)
+
+// Registers a third-party protocol, making it available to `Query` (by its name and aliases) and `Detect`
+// of every client not restricted with `WithProtocols`. Panics if a protocol with the same name is already registered.
+func RegisterProtocol(queryProtocol protocol.Protocol) {
+	if queryProtocol == nil {
+		panic("gamequery: RegisterProtocol protocol is nil")
+	}
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if containsProtocol(queryProtocols, queryProtocol) {
+		panic("gamequery: RegisterProtocol called twice for protocol " + queryProtocol.Name())
+	}
+
+	queryProtocols = append(queryProtocols, queryProtocol)
 }
 
-func findProtocols(name string) []internal.Protocol {
-	found := make([]internal.Protocol, 0)
-	for _, protocol := range queryProtocols {
-		if protocol.Name() == name {
-			found = append(found, protocol)
+func registeredProtocols() []protocol.Protocol {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	registered := make([]protocol.Protocol, len(queryProtocols))
+	copy(registered, queryProtocols)
+
+	return registered
+}
+
+var defaultClient = NewClient()
+
+func findProtocols(available []protocol.Protocol, name string) []protocol.Protocol {
+	found := make([]protocol.Protocol, 0)
+	for _, queryProtocol := range available {
+		if queryProtocol.Name() == name {
+			found = append(found, queryProtocol)
 		} else {
-			for _, protocolName := range protocol.Aliases() {
+			for _, protocolName := range queryProtocol.Aliases() {
 				if protocolName == name {
-					found = append(found, protocol)
+					found = append(found, queryProtocol)
 				}
 			}
 		}
@@ -33,96 +70,344 @@ func findProtocols(name string) []internal.Protocol {
 	return found
 }
 
+func containsProtocol(list []protocol.Protocol, queryProtocol protocol.Protocol) bool {
+	for _, entry := range list {
+		if entry.Name() == queryProtocol.Name() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A protocol and port pair to query the game server with.
+type queryCandidate struct {
+	Protocol protocol.Protocol
+	Port     uint16
+	Rank     int // Position of the port in the candidate ports
+}
+
 type queryResult struct {
+	Index    int
 	Name     string
 	Priority uint16
+	Port     uint16
+	Elapsed  time.Duration
 	Err      error
 	Response api.Response
 }
 
+// Common offsets of the query port from the game port.
+var commonPortOffsets = []uint16{0, 1, 2, 10, 123}
+
+// Returns the ports to query the game server on, ordered by preference. A port of 0 means the protocol's default.
+func candidatePorts(req api.Request) []uint16 {
+	var ports []uint16
+	if len(req.Ports) > 0 {
+		ports = req.Ports
+	} else if req.ScanPortOffsets && req.Port != 0 {
+		for _, offset := range commonPortOffsets {
+			if int(req.Port)+int(offset) <= 0xFFFF {
+				ports = append(ports, req.Port+offset)
+			}
+		}
+	} else {
+		return []uint16{req.Port}
+	}
+
+	unique := make([]uint16, 0, len(ports))
+	seen := make(map[uint16]bool)
+	for _, port := range ports {
+		if !seen[port] {
+			seen[port] = true
+			unique = append(unique, port)
+		}
+	}
+
+	return unique
+}
+
 // Query the game server by detecting the protocol (trying all available protocols).
 // This usually should be used as the initial query function and then use `Query` function
-// with the returned protocol if the query succeeds. Otherwise each function call will take always
-// <req.Timeout> duration even if the response was received earlier from one of the protocols.
+// with the returned protocol if the query succeeds. Detect returns as soon as the highest priority protocol
+// succeeded (or all of the higher priority ones failed), though it still sends queries for every protocol.
 func Detect(req api.Request) (api.Response, string, error) {
-	return query(req, queryProtocols)
+	return defaultClient.Detect(req)
 }
 
-// Query the game server using the protocol provided in req.Game.
+// Same as `Detect`, but aborts all of the in-flight protocol queries as soon as ctx is done.
+func DetectContext(ctx context.Context, req api.Request) (api.Response, string, error) {
+	return defaultClient.DetectContext(ctx, req)
+}
+
+// Query the game server using the protocol provided in req.Game. Games from the catalog (see `Games`) are accepted too,
+// in which case req.Port is the game port (rather than the query port) of the server.
 func Query(req api.Request) (api.Response, error) {
-	chosenProtocols := findProtocols(req.Game)
+	return defaultClient.Query(req)
+}
+
+// Same as `Query`, but aborts the in-flight query as soon as ctx is done.
+func QueryContext(ctx context.Context, req api.Request) (api.Response, error) {
+	return defaultClient.QueryContext(ctx, req)
+}
+
+func (c *Client) query(ctx context.Context, req api.Request, chosenProtocols []protocol.Protocol) (api.Response, string, error) {
+	if err := ctx.Err(); err != nil {
+		return api.Response{}, "", err
+	}
+
+	// E.g. a client restricted by `WithProtocols` to names not matching any protocol.
 	if len(chosenProtocols) < 1 {
-		return api.Response{}, errors.New("could not find protocols for the game")
+		return api.Response{}, "", fmt.Errorf("%w: no protocols are enabled", api.ErrUnknownProtocol)
 	}
 
-	response, _, err := query(req, chosenProtocols)
-	return response, err
-}
+	// Cancelling the context once we've got our answer closes the sockets of the protocols still in-flight.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-func query(req api.Request, chosenProtocols []internal.Protocol) (api.Response, string, error) {
-	var wg sync.WaitGroup
-	wg.Add(len(chosenProtocols))
+	if req.TotalTimeout != nil {
+		ctx, cancel = context.WithTimeout(ctx, *req.TotalTimeout)
+		defer cancel()
+	}
 
-	queryResults := make([]queryResult, len(chosenProtocols))
-	for index, queryProtocol := range chosenProtocols {
-		go func(queryProtocol internal.Protocol, index int) {
-			defer wg.Done()
+	// Every candidate port is tried with every protocol, preferring the protocols' priority over the ports' order.
+	var candidates []queryCandidate
+	for _, queryProtocol := range chosenProtocols {
+		for rank, port := range candidatePorts(req) {
+			candidates = append(candidates, queryCandidate{
+				Protocol: queryProtocol,
+				Port:     port,
+				Rank:     rank,
+			})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Protocol.Priority() != candidates[j].Protocol.Priority() {
+			return candidates[i].Protocol.Priority() > candidates[j].Protocol.Priority()
+		}
 
-			var port = queryProtocol.DefaultPort()
-			if req.Port != 0 {
-				port = req.Port
+		return candidates[i].Rank < candidates[j].Rank
+	})
+
+	// Buffered so that the goroutines never block on sending their result, even after we've returned.
+	results := make(chan queryResult, len(candidates))
+	for index, candidate := range candidates {
+		go func(candidate queryCandidate, index int) {
+			candidateReq := req
+			candidateReq.Port = candidate.Port
+
+			start := time.Now()
+			response, err := c.queryProtocol(ctx, candidateReq, candidate.Protocol)
+			if err != nil && ctx.Err() == nil {
+				c.logger.Debug("gamequery: protocol query failed", "protocol", candidate.Protocol.Name(), "port", candidate.Port, "error", err)
 			}
 
-			var timeout = 5 * time.Second
-			if req.Timeout != nil {
-				timeout = *req.Timeout
+			results <- queryResult{
+				Index:    index,
+				Name:     candidate.Protocol.Name(),
+				Priority: candidate.Protocol.Priority(),
+				Port:     candidate.Port,
+				Elapsed:  time.Since(start),
+				Err:      err,
+				Response: response,
 			}
+		}(candidate, index)
+	}
 
-			networkHelper := internal.NetworkHelper{}
-			if err := networkHelper.Initialize(queryProtocol.Network(), req.IP, port, timeout); err != nil {
-				queryResults[index] = queryResult{
-					Priority: queryProtocol.Priority(),
-					Err:      err,
-					Response: api.Response{},
-				}
-				return
+	queryResults := make([]*queryResult, len(candidates))
+	for range candidates {
+		result := <-results
+		queryResults[result.Index] = &result
+
+		if best := bestResult(candidates, queryResults); best != nil {
+			return best.Response, best.Name, nil
+		}
+	}
+
+	detectErr := &DetectError{
+		Protocols: make([]*ProtocolError, len(queryResults)),
+	}
+	for index, result := range queryResults {
+		detectErr.Protocols[index] = &ProtocolError{
+			Protocol: result.Name,
+			Priority: result.Priority,
+			Port:     result.Port,
+			Elapsed:  result.Elapsed,
+			Err:      result.Err,
+		}
+	}
+
+	return api.Response{}, "", detectErr
+}
+
+// Returns the successful result which can't be beaten anymore by the candidates still in-flight, if there's one.
+// The candidates are expected to be sorted by preference (protocol priority, then port rank), with nil results
+// for the in-flight ones. Protocols of the same priority on the same port are equally preferred.
+func bestResult(candidates []queryCandidate, queryResults []*queryResult) *queryResult {
+	var blocking *queryCandidate
+	for index, result := range queryResults {
+		if result == nil {
+			if blocking == nil {
+				blocking = &candidates[index]
 			}
-			defer networkHelper.Close()
-
-			response, err := queryProtocol.Execute(networkHelper)
-			if err != nil {
-				queryResults[index] = queryResult{
-					Priority: queryProtocol.Priority(),
-					Err:      err,
-					Response: api.Response{},
-				}
-				return
+
+			continue
+		}
+
+		if result.Err == nil && (blocking == nil || (result.Priority == blocking.Protocol.Priority() && result.Port == blocking.Port)) {
+			return result
+		}
+	}
+
+	return nil
+}
+
+// Queries the game server with a single protocol. TCP protocols are retried as a whole according to the retry policy,
+// while UDP protocols retransmit their individual exchanges themselves (see `protocol.Retry`).
+func (c *Client) queryProtocol(ctx context.Context, req api.Request, queryProtocol protocol.Protocol) (api.Response, error) {
+	if req.Retry == nil {
+		req.Retry = &c.retry
+	}
+
+	attempts := req.Retry.Attempts
+	if attempts < 1 || queryProtocol.Network() == "udp" {
+		attempts = 1
+	}
+
+	var response api.Response
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			c.logger.Debug("gamequery: retrying protocol query", "protocol", queryProtocol.Name(), "attempt", attempt+1, "error", err)
+
+			timer := time.NewTimer(protocol.Backoff(*req.Retry, attempt))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return api.Response{}, ctx.Err()
 			}
+		}
+
+		response, err = c.executeProtocol(ctx, req, queryProtocol)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+
+	return response, err
+}
+
+// Delay before racing the fallback address family, as recommended by RFC 8305 (Happy Eyeballs v2).
+const fallbackDelay = 300 * time.Millisecond
+
+func (c *Client) executeProtocol(ctx context.Context, req api.Request, queryProtocol protocol.Protocol) (api.Response, error) {
+	targets, err := c.resolve(ctx, req, queryProtocol)
+	if err != nil {
+		return api.Response{}, err
+	}
+
+	if len(targets) == 1 {
+		return c.executeTarget(ctx, req, queryProtocol, targets[0])
+	}
+
+	return c.raceTargets(ctx, req, queryProtocol, targets)
+}
 
-			queryResults[index] = queryResult{
-				Name:     queryProtocol.Name(),
-				Priority: queryProtocol.Priority(),
-				Err:      nil,
+type targetResult struct {
+	Response api.Response
+	Err      error
+}
+
+// Queries the targets happy eyeballs style: the fallback targets are started after a delay, or right away
+// once the previous target failed, and the first success wins.
+func (c *Client) raceTargets(ctx context.Context, req api.Request, queryProtocol protocol.Protocol, targets []queryTarget) (api.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan targetResult, len(targets))
+	var started = 0
+	startNext := func() {
+		go func(target queryTarget) {
+			response, err := c.executeTarget(ctx, req, queryProtocol, target)
+			results <- targetResult{
 				Response: response,
+				Err:      err,
 			}
-		}(queryProtocol, index)
+		}(targets[started])
+
+		started++
 	}
 
-	wg.Wait()
-	sort.Slice(queryResults, func(i, j int) bool {
-		return queryResults[i].Priority > queryResults[j].Priority
-	})
+	startNext()
+
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
 
-	var firstError error
-	for _, result := range queryResults {
-		if result.Err != nil {
-			if firstError == nil {
-				firstError = result.Err
+	var errs []error
+	for finished := 0; finished < started; {
+		select {
+		case <-timer.C:
+			if started < len(targets) {
+				c.logger.Debug("gamequery: starting fallback address family", "protocol", queryProtocol.Name(), "address", targets[started].IP)
+
+				startNext()
+				timer.Reset(fallbackDelay)
+			}
+		case result := <-results:
+			finished++
+			if result.Err == nil {
+				return result.Response, nil
+			}
+
+			errs = append(errs, result.Err)
+
+			if started < len(targets) {
+				startNext()
 			}
-		} else {
-			return result.Response, result.Name, nil
 		}
 	}
 
-	return api.Response{}, "", firstError
+	// Keeps the error of a single target as is, rather than wrapping it.
+	if len(errs) == 1 {
+		return api.Response{}, errs[0]
+	}
+
+	return api.Response{}, errors.Join(errs...)
+}
+
+func (c *Client) executeTarget(ctx context.Context, req api.Request, queryProtocol protocol.Protocol, target queryTarget) (api.Response, error) {
+	if err := c.acquire(ctx); err != nil {
+		return api.Response{}, err
+	}
+	defer c.release()
+
+	// The total timeout caps the per-operation one through the context's deadline.
+	var timeout = c.timeout
+	if req.Timeout != nil {
+		timeout = *req.Timeout
+	}
+
+	dialer, err := c.protocolDialer(req, queryProtocol)
+	if err != nil {
+		return api.Response{}, err
+	}
+
+	networkHelper := internal.NetworkHelper{}
+	if err := networkHelper.Initialize(ctx, dialer, c.logger, queryProtocol.Network(), target.Host, target.IP, target.Port, timeout); err != nil {
+		return api.Response{}, err
+	}
+	defer networkHelper.Close()
+
+	response, err := queryProtocol.Execute(ctx, req, &networkHelper)
+	if err != nil {
+		return api.Response{}, err
+	}
+
+	response.Address = net.JoinHostPort(target.IP, strconv.Itoa(int(target.Port)))
+	response.Port = target.Port
+	response.Network = target.Network
+
+	return response, nil
 }
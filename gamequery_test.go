@@ -0,0 +1,170 @@
+package gamequery
+
+import (
+	"context"
+	"errors"
+	"github.com/wisp-gg/gamequery/api"
+	"github.com/wisp-gg/gamequery/protocol"
+	"reflect"
+	"testing"
+)
+
+// Protocol only carrying the fields Detect orders its candidates by.
+type fakeProtocol struct {
+	name     string
+	priority uint16
+}
+
+func (p fakeProtocol) Name() string        { return p.name }
+func (p fakeProtocol) Aliases() []string   { return nil }
+func (p fakeProtocol) DefaultPort() uint16 { return 27015 }
+func (p fakeProtocol) Priority() uint16    { return p.priority }
+func (p fakeProtocol) Network() string     { return "udp" }
+
+func (p fakeProtocol) Execute(context.Context, api.Request, protocol.Transport) (api.Response, error) {
+	return api.Response{}, errors.New("fakeProtocol can't be executed")
+}
+
+type resultState int
+
+const (
+	pending resultState = iota
+	failed
+	succeeded
+)
+
+func TestBestResult(t *testing.T) {
+	high := fakeProtocol{name: "high", priority: 10}
+	highToo := fakeProtocol{name: "high_too", priority: 10}
+	low := fakeProtocol{name: "low", priority: 1}
+
+	// The candidates are listed in the order `query` sorts them in: by priority, then by port rank.
+	tests := []struct {
+		name       string
+		candidates []queryCandidate
+		states     []resultState
+		want       int // Index of the expected result, -1 when Detect has to keep waiting (or everything failed)
+	}{
+		{
+			name:       "highest priority succeeded",
+			candidates: []queryCandidate{{Protocol: high, Port: 27015}, {Protocol: low, Port: 27015}},
+			states:     []resultState{succeeded, pending},
+			want:       0,
+		},
+		{
+			name:       "lower priority waits for the higher one",
+			candidates: []queryCandidate{{Protocol: high, Port: 27015}, {Protocol: low, Port: 27015}},
+			states:     []resultState{pending, succeeded},
+			want:       -1,
+		},
+		{
+			name:       "lower priority after the higher one failed",
+			candidates: []queryCandidate{{Protocol: high, Port: 27015}, {Protocol: low, Port: 27015}},
+			states:     []resultState{failed, succeeded},
+			want:       1,
+		},
+		{
+			name:       "later port waits for the earlier one",
+			candidates: []queryCandidate{{Protocol: high, Port: 27015, Rank: 0}, {Protocol: high, Port: 27016, Rank: 1}},
+			states:     []resultState{pending, succeeded},
+			want:       -1,
+		},
+		{
+			name:       "later port after the earlier one failed",
+			candidates: []queryCandidate{{Protocol: high, Port: 27015, Rank: 0}, {Protocol: high, Port: 27016, Rank: 1}},
+			states:     []resultState{failed, succeeded},
+			want:       1,
+		},
+		{
+			name:       "equal priority on the same port ties",
+			candidates: []queryCandidate{{Protocol: high, Port: 27015}, {Protocol: highToo, Port: 27015}},
+			states:     []resultState{pending, succeeded},
+			want:       1,
+		},
+		{
+			name:       "equal priority tie prefers the earlier candidate",
+			candidates: []queryCandidate{{Protocol: high, Port: 27015}, {Protocol: highToo, Port: 27015}},
+			states:     []resultState{succeeded, succeeded},
+			want:       0,
+		},
+		{
+			name: "equal priority on another port doesn't tie",
+			candidates: []queryCandidate{
+				{Protocol: high, Port: 27015, Rank: 0},
+				{Protocol: highToo, Port: 27015, Rank: 0},
+				{Protocol: high, Port: 27016, Rank: 1},
+			},
+			states: []resultState{pending, failed, succeeded},
+			want:   -1,
+		},
+		{
+			name:       "lower priority doesn't tie on the same port",
+			candidates: []queryCandidate{{Protocol: high, Port: 27015}, {Protocol: low, Port: 27015}},
+			states:     []resultState{pending, succeeded},
+			want:       -1,
+		},
+		{
+			name:       "everything failed",
+			candidates: []queryCandidate{{Protocol: high, Port: 27015}, {Protocol: low, Port: 27015}},
+			states:     []resultState{failed, failed},
+			want:       -1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queryResults := make([]*queryResult, len(test.candidates))
+			for index, state := range test.states {
+				if state == pending {
+					continue
+				}
+
+				candidate := test.candidates[index]
+				queryResults[index] = &queryResult{
+					Index:    index,
+					Name:     candidate.Protocol.Name(),
+					Priority: candidate.Protocol.Priority(),
+					Port:     candidate.Port,
+				}
+				if state == failed {
+					queryResults[index].Err = api.ErrTimeout
+				}
+			}
+
+			got := -1
+			if result := bestResult(test.candidates, queryResults); result != nil {
+				got = result.Index
+			}
+
+			if got != test.want {
+				t.Errorf("got result %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCandidatePorts(t *testing.T) {
+	tests := []struct {
+		name string
+		req  api.Request
+		want []uint16
+	}{
+		{name: "single port", req: api.Request{Port: 27015}, want: []uint16{27015}},
+		{name: "default port", req: api.Request{}, want: []uint16{0}},
+		{name: "explicit ports", req: api.Request{Port: 1, Ports: []uint16{27016, 27015}}, want: []uint16{27016, 27015}},
+		{name: "explicit ports deduplicated", req: api.Request{Ports: []uint16{27015, 27016, 27015}}, want: []uint16{27015, 27016}},
+		{name: "explicit ports override offsets", req: api.Request{Port: 1, Ports: []uint16{27015}, ScanPortOffsets: true}, want: []uint16{27015}},
+		{name: "offsets", req: api.Request{Port: 27015, ScanPortOffsets: true}, want: []uint16{27015, 27016, 27017, 27025, 27138}},
+		{name: "offsets without a port", req: api.Request{ScanPortOffsets: true}, want: []uint16{0}},
+		{name: "offsets overflowing", req: api.Request{Port: 65530, ScanPortOffsets: true}, want: []uint16{65530, 65531, 65532}},
+		{name: "offsets at the last port", req: api.Request{Port: 65535, ScanPortOffsets: true}, want: []uint16{65535}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := candidatePorts(test.req); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
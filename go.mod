@@ -1,3 +1,3 @@
 module github.com/wisp-gg/gamequery
 
-go 1.13
+go 1.20
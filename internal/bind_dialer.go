@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// Dials (and listens) from a fixed local IP and optionally a local port out of the given range,
+// the zero value letting the kernel pick both.
+type BindDialer struct {
+	IP      net.IP
+	MinPort uint16 // First port of the range, 0 means any port
+	MaxPort uint16 // Last port of the range (inclusive)
+}
+
+// Calls bind with the ports of the range (starting from a random one) until one isn't in use.
+func (dialer BindDialer) bindPort(bind func(port int) error) error {
+	if dialer.MinPort == 0 {
+		return bind(0)
+	}
+
+	count := int(dialer.MaxPort) - int(dialer.MinPort) + 1
+	if count < 1 {
+		count = 1
+	}
+
+	var err error
+	offset := rand.Intn(count)
+	for i := 0; i < count; i++ {
+		err = bind(int(dialer.MinPort) + (offset+i)%count)
+		if err == nil || !(errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL)) {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (dialer BindDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var conn net.Conn
+	err := dialer.bindPort(func(port int) error {
+		netDialer := net.Dialer{}
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			netDialer.LocalAddr = &net.TCPAddr{IP: dialer.IP, Port: port}
+		case "udp", "udp4", "udp6":
+			netDialer.LocalAddr = &net.UDPAddr{IP: dialer.IP, Port: port}
+		}
+
+		var err error
+		conn, err = netDialer.DialContext(ctx, network, address)
+
+		return err
+	})
+
+	return conn, err
+}
+
+func (dialer BindDialer) ListenPacket() (net.PacketConn, error) {
+	var conn net.PacketConn
+	err := dialer.bindPort(func(port int) error {
+		host := ""
+		if dialer.IP != nil {
+			host = dialer.IP.String()
+		}
+
+		var err error
+		conn, err = net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+
+		return err
+	})
+
+	return conn, err
+}
@@ -2,9 +2,15 @@ package internal
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/wisp-gg/gamequery/api"
+	"github.com/wisp-gg/gamequery/protocol"
 	"io"
 	"net"
+	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -13,48 +19,148 @@ const (
 )
 
 type NetworkHelper struct {
+	ctx     context.Context
+	host    string
 	ip      string
 	port    uint16
 	conn    net.Conn
 	timeout time.Duration
+	logger  protocol.Logger
+	done    chan struct{}
 }
 
-func (helper *NetworkHelper) Initialize(protocol string, ip string, port uint16, timeout time.Duration) error {
-	conn, err := net.DialTimeout(protocol, fmt.Sprintf("%s:%d", ip, port), timeout)
+func (helper *NetworkHelper) Initialize(ctx context.Context, dialer protocol.Dialer, logger protocol.Logger, network string, host string, ip string, port uint16, timeout time.Duration) error {
+	address := net.JoinHostPort(ip, strconv.Itoa(int(port)))
+	logger.Debug("gamequery: dialing", "network", network, "address", address)
+
+	dialCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	conn, err := dialer.DialContext(dialCtx, network, address)
 	if err != nil {
-		return err
+		logger.Debug("gamequery: dial failed", "network", network, "address", address, "error", err)
+
+		if ctxErr := contextError(ctx); ctxErr != nil {
+			return ctxErr
+		}
+
+		return classifyError(err)
 	}
 
+	helper.ctx = ctx
+	helper.host = host
 	helper.ip = ip
 	helper.port = port
 	helper.conn = conn
 	helper.timeout = timeout
+	helper.logger = logger
+	helper.done = make(chan struct{})
+
+	go helper.watchContext()
 
 	return nil
 }
 
+// Closes the underlying connection as soon as the context is done, which unblocks
+// any pending Send/Receive call.
+func (helper *NetworkHelper) watchContext() {
+	select {
+	case <-helper.ctx.Done():
+		_ = helper.conn.Close()
+	case <-helper.done:
+	}
+}
+
+// Returns the deadline for a single operation, the zero time meaning no deadline at all.
 func (helper *NetworkHelper) getTimeout() time.Time {
-	return time.Now().Add(helper.timeout)
+	var deadline time.Time
+	if helper.timeout > 0 {
+		deadline = time.Now().Add(helper.timeout)
+	}
+
+	if ctxDeadline, ok := helper.ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		return ctxDeadline
+	}
+
+	return deadline
+}
+
+// Matches both api.ErrTimeout and context.DeadlineExceeded, as the query's overall deadline is a timeout too.
+type deadlineError struct{}
+
+func (deadlineError) Error() string {
+	return "timed out: query deadline exceeded"
+}
+
+func (deadlineError) Is(target error) bool {
+	return target == api.ErrTimeout || target == context.DeadlineExceeded
+}
+
+func contextError(ctx context.Context) error {
+	err := ctx.Err()
+	if err == context.DeadlineExceeded {
+		return deadlineError{}
+	}
+
+	return err
+}
+
+// Prefers the context's error over the network one, as the latter is usually
+// just a side effect of the connection being closed by watchContext.
+func (helper *NetworkHelper) wrapError(err error) error {
+	if ctxErr := contextError(helper.ctx); ctxErr != nil {
+		return ctxErr
+	}
+
+	return classifyError(err)
+}
+
+// Wraps the network error with the matching api sentinel error, if there's one.
+func classifyError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %s", api.ErrTimeout, err)
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("%w: %s", api.ErrConnectionRefused, err)
+	}
+
+	return err
 }
 
 func (helper *NetworkHelper) Send(data []byte) error {
+	if err := contextError(helper.ctx); err != nil {
+		return err
+	}
+
 	err := helper.conn.SetWriteDeadline(helper.getTimeout())
 	if err != nil {
-		return err
+		return helper.wrapError(err)
 	}
 
 	_, err = helper.conn.Write(data)
 	if err != nil {
-		return err
+		return helper.wrapError(err)
 	}
 
+	helper.logger.Debug("gamequery: sent packet", "address", helper.conn.RemoteAddr().String(), "size", len(data))
+
 	return nil
 }
 
-func (helper *NetworkHelper) Receive() (Packet, error) {
+func (helper *NetworkHelper) Receive() (protocol.Packet, error) {
+	if err := contextError(helper.ctx); err != nil {
+		return protocol.Packet{}, err
+	}
+
 	err := helper.conn.SetReadDeadline(helper.getTimeout())
 	if err != nil {
-		return Packet{}, err
+		return protocol.Packet{}, helper.wrapError(err)
 	}
 
 	var res = &bytes.Buffer{}
@@ -71,7 +177,7 @@ func (helper *NetworkHelper) Receive() (Packet, error) {
 				break
 			}
 
-			return Packet{}, err
+			return protocol.Packet{}, helper.wrapError(err)
 		}
 
 		if recvSize < readBufSize {
@@ -79,16 +185,24 @@ func (helper *NetworkHelper) Receive() (Packet, error) {
 		}
 	}
 
-	packet := Packet{}
+	helper.logger.Debug("gamequery: received packet", "address", helper.conn.RemoteAddr().String(), "size", res.Len())
+
+	packet := protocol.Packet{}
 	packet.SetBuffer(res.Bytes())
 
 	return packet, nil
 }
 
 func (helper *NetworkHelper) Close() error {
+	close(helper.done)
+
 	return helper.conn.Close()
 }
 
+func (helper *NetworkHelper) GetHost() string {
+	return helper.host
+}
+
 func (helper *NetworkHelper) GetIP() string {
 	return helper.ip
 }
@@ -96,3 +210,7 @@ func (helper *NetworkHelper) GetIP() string {
 func (helper *NetworkHelper) GetPort() uint16 {
 	return helper.port
 }
+
+func (helper *NetworkHelper) Logger() protocol.Logger {
+	return helper.logger
+}
@@ -1,12 +1,13 @@
 package protocols
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/wisp-gg/gamequery/api"
-	"github.com/wisp-gg/gamequery/internal"
+	"github.com/wisp-gg/gamequery/protocol"
+	"time"
 )
 
 type MinecraftTCP struct{}
@@ -33,11 +34,15 @@ func (mc MinecraftTCP) Network() string {
 	return "tcp"
 }
 
-func buildMCPacket(bulkData ...interface{}) *internal.Packet {
-	packet := internal.Packet{}
+func (mc MinecraftTCP) SRVService() (string, string) {
+	return "minecraft", "tcp"
+}
+
+func buildMCPacket(logger protocol.Logger, bulkData ...interface{}) *protocol.Packet {
+	packet := protocol.Packet{}
 	packet.SetOrder(binary.BigEndian)
 
-	tmpPacket := internal.Packet{}
+	tmpPacket := protocol.Packet{}
 	tmpPacket.SetOrder(binary.BigEndian)
 	for _, data := range bulkData {
 		switch val := data.(type) {
@@ -51,7 +56,7 @@ func buildMCPacket(bulkData ...interface{}) *internal.Packet {
 		case []byte:
 			tmpPacket.WriteRaw(val...)
 		default:
-			fmt.Printf("gamequery: unhandled type %s for Minecraft TCP packet, ignoring...\n", val)
+			logger.Debug("gamequery: unhandled type for Minecraft TCP packet, ignoring", "type", fmt.Sprintf("%T", val))
 		}
 	}
 
@@ -61,26 +66,58 @@ func buildMCPacket(bulkData ...interface{}) *internal.Packet {
 	return &packet
 }
 
-func (mc MinecraftTCP) Execute(helper internal.NetworkHelper) (api.Response, error) {
-	err := helper.Send(buildMCPacket([]byte{0x00, 0x00}, helper.GetIP(), helper.GetPort(), 0x01).GetBuffer())
+// Measures the round trip time of the ping/pong packet exchange.
+func (mc MinecraftTCP) ping(transport protocol.Transport) (time.Duration, error) {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+
+	sentAt := time.Now()
+	err := transport.Send(buildMCPacket(transport.Logger(), 0x01, payload).GetBuffer())
+	if err != nil {
+		return 0, err
+	}
+
+	pongPacket, err := transport.Receive()
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(sentAt)
+
+	pongPacket.SetOrder(binary.BigEndian)
+	pongPacket.ReadVarint() // Packet length
+	if pongPacket.ReadVarint() != 0x01 {
+		return 0, fmt.Errorf("%w: received something else than a pong response", api.ErrMalformedResponse)
+	}
+
+	if pongPacket.ReadUint64() != binary.BigEndian.Uint64(payload) || pongPacket.IsInvalid() {
+		return 0, fmt.Errorf("%w: received pong with wrong payload", api.ErrMalformedResponse)
+	}
+
+	return rtt, nil
+}
+
+func (mc MinecraftTCP) Execute(ctx context.Context, req api.Request, transport protocol.Transport) (api.Response, error) {
+	err := transport.Send(buildMCPacket(transport.Logger(), []byte{0x00, 0x00}, transport.GetHost(), transport.GetPort(), 0x01).GetBuffer())
 	if err != nil {
 		return api.Response{}, err
 	}
 
-	err = helper.Send(buildMCPacket(0x00).GetBuffer())
+	sentAt := time.Now()
+	err = transport.Send(buildMCPacket(transport.Logger(), 0x00).GetBuffer())
 	if err != nil {
 		return api.Response{}, err
 	}
 
-	responsePacket, err := helper.Receive()
+	responsePacket, err := transport.Receive()
 	if err != nil {
 		return api.Response{}, err
 	}
+	statusRtt := time.Since(sentAt)
 
 	packetLength := responsePacket.ReadVarint()
 	packetId := responsePacket.ReadVarint()
 	if packetId != 0 {
-		return api.Response{}, errors.New("received something else than a status response")
+		return api.Response{}, fmt.Errorf("%w: received something else than a status response", api.ErrMalformedResponse)
 	}
 
 	if packetId > packetLength {
@@ -91,18 +128,33 @@ func (mc MinecraftTCP) Execute(helper internal.NetworkHelper) (api.Response, err
 	jsonBody := responsePacket.ReadString()
 
 	if responsePacket.IsInvalid() {
-		return api.Response{}, errors.New("received packet is invalid")
+		return api.Response{}, fmt.Errorf("%w: received packet is invalid", api.ErrMalformedResponse)
 	}
 
 	raw := api.MinecraftTCPRaw{}
 	err = json.Unmarshal([]byte(jsonBody), &raw)
 	if err != nil {
-		return api.Response{}, err
+		return api.Response{}, fmt.Errorf("%w: %s", api.ErrMalformedResponse, err)
 	}
 
 	var playerList []string
+	var players []api.Player
 	for _, player := range raw.Players.Sample {
 		playerList = append(playerList, player.Name)
+		players = append(players, api.Player{
+			Name: player.Name,
+			ID:   player.ID,
+		})
+	}
+
+	// The server closes the connection after the pong, so only a single sample can be measured.
+	// Not every server implements the ping packet, in which case the status request's round trip is used.
+	ping, err := mc.ping(transport)
+	if err != nil && ctx.Err() != nil {
+		// A cancelled query shouldn't be reported as a success.
+		return api.Response{}, ctx.Err()
+	} else if err != nil {
+		ping = statusRtt
 	}
 
 	return api.Response{
@@ -111,8 +163,12 @@ func (mc MinecraftTCP) Execute(helper internal.NetworkHelper) (api.Response, err
 			Current: raw.Players.Online,
 			Max:     raw.Players.Max,
 			Names:   playerList,
+			List:    players,
 		},
 
+		Version: raw.Version.Name,
+		Ping:    ping,
+
 		Raw: raw,
 	}, nil
 }
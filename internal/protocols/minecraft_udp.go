@@ -2,12 +2,14 @@ package protocols
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
-	"errors"
+	"fmt"
 	"github.com/wisp-gg/gamequery/api"
-	"github.com/wisp-gg/gamequery/internal"
+	"github.com/wisp-gg/gamequery/protocol"
 	"math/rand"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -35,10 +37,30 @@ func (mc MinecraftUDP) Network() string {
 	return "udp"
 }
 
+func (mc MinecraftUDP) SRVService() (string, string) {
+	return "minecraft", "tcp"
+}
+
+// Replies echo the request's session ID, which follows the FE FD magic and packet type in requests.
+func (mc MinecraftUDP) MatchResponse(sent, received []byte) bool {
+	if len(sent) < 7 || len(received) < 5 {
+		return false
+	}
+
+	return bytes.Equal(received[1:5], sent[3:7])
+}
+
+// Source of the session IDs, kept apart from the global one so that other users of math/rand aren't affected.
+var (
+	sessionIDMutex sync.Mutex
+	sessionIDRand  = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
 func generateSessionID() int32 {
-	rand.Seed(time.Now().UTC().UnixNano())
+	sessionIDMutex.Lock()
+	defer sessionIDMutex.Unlock()
 
-	return rand.Int31() & 0x0F0F0F0F
+	return sessionIDRand.Int31() & 0x0F0F0F0F
 }
 
 func parseChallengeToken(challengeToken string) ([]byte, error) {
@@ -56,61 +78,122 @@ func parseChallengeToken(challengeToken string) ([]byte, error) {
 	return buf.Bytes()[buf.Len()-4:], nil
 }
 
-func (mc MinecraftUDP) Execute(helper internal.NetworkHelper) (api.Response, error) {
-	sessionId := generateSessionID()
+// Receives the reply of the given type for the session, skipping late replies to previous exchanges
+// (e.g. retransmitted handshakes of other sessions).
+func (mc MinecraftUDP) receive(transport protocol.Transport, wantedType uint8, sessionId int32) (protocol.Packet, error) {
+	for {
+		packet, err := transport.Receive()
+		if err != nil {
+			return protocol.Packet{}, err
+		}
+
+		packet.SetOrder(binary.BigEndian)
+		packetType, packetSessionId := packet.ReadUint8(), packet.ReadInt32()
+		if packetType == wantedType && packetSessionId == sessionId {
+			return packet, nil
+		}
+
+		if packet.IsInvalid() || (packetType != 0x09 && packetType != 0x00) {
+			return protocol.Packet{}, fmt.Errorf("%w: received unknown response type %d", api.ErrMalformedResponse, packetType)
+		}
+
+		transport.Logger().Debug("gamequery: skipping stale response", "type", packetType, "session", packetSessionId)
+	}
+}
 
-	packet := internal.Packet{}
+// Requests a challenge token, returning it along with the round trip time of the handshake.
+func (mc MinecraftUDP) handshake(transport protocol.Transport, sessionId int32) ([]byte, time.Duration, error) {
+	packet := protocol.Packet{}
 	packet.SetOrder(binary.BigEndian)
 	packet.WriteRaw(0xFE, 0xFD, 0x09)
 	packet.WriteInt32(sessionId)
 
-	err := helper.Send(packet.GetBuffer())
+	sentAt := time.Now()
+	err := transport.Send(packet.GetBuffer())
 	if err != nil {
-		return api.Response{}, err
+		return []byte{}, 0, err
 	}
 
-	handshakePacket, err := helper.Receive()
+	handshakePacket, err := mc.receive(transport, 0x09, sessionId)
 	if err != nil {
-		return api.Response{}, err
-	}
-
-	handshakePacket.SetOrder(binary.BigEndian)
-	if handshakePacket.ReadUint8() != 0x09 {
-		return api.Response{}, errors.New("sent a handshake, but didn't receive handshake response back")
-	}
-
-	if handshakePacket.ReadInt32() != sessionId {
-		return api.Response{}, errors.New("received handshake for wrong session id")
+		return []byte{}, 0, err
 	}
+	rtt := time.Since(sentAt)
 
 	challengeToken, err := parseChallengeToken(handshakePacket.ReadString())
 	if err != nil {
-		return api.Response{}, err
+		return []byte{}, 0, fmt.Errorf("%w: %s", api.ErrMalformedResponse, err)
 	}
 
-	packet.Clear()
+	transport.Logger().Debug("gamequery: received challenge token", "session", sessionId, "rtt", rtt)
+
+	return challengeToken, rtt, nil
+}
+
+// Requests the full stat, returning the response positioned after its header.
+func (mc MinecraftUDP) stat(transport protocol.Transport, sessionId int32, challengeToken []byte) (protocol.Packet, error) {
+	packet := protocol.Packet{}
+	packet.SetOrder(binary.BigEndian)
 	packet.WriteRaw(0xFE, 0xFD, 0x00)
 	packet.WriteInt32(sessionId)
 	packet.WriteRaw(challengeToken...)
 	packet.WriteRaw(0x00, 0x00, 0x00, 0x00)
 
-	err = helper.Send(packet.GetBuffer())
+	err := transport.Send(packet.GetBuffer())
 	if err != nil {
-		return api.Response{}, err
+		return protocol.Packet{}, err
 	}
 
-	responsePacket, err := helper.Receive()
+	return mc.receive(transport, 0x00, sessionId)
+}
+
+func (mc MinecraftUDP) Execute(ctx context.Context, req api.Request, transport protocol.Transport) (api.Response, error) {
+	// Every handshake attempt uses a new session, so that late replies to the previous attempts are told apart.
+	var sessionId int32
+	var challengeToken []byte
+	var ping time.Duration
+	err := protocol.Retry(ctx, req, func(attempt int) error {
+		var err error
+		sessionId = generateSessionID()
+		challengeToken, ping, err = mc.handshake(transport, sessionId)
+
+		return err
+	})
 	if err != nil {
 		return api.Response{}, err
 	}
 
-	responsePacket.SetOrder(binary.BigEndian)
-	if responsePacket.ReadUint8() != 0x00 {
-		return api.Response{}, errors.New("sent a full stat request, but didn't receive stat response back")
+	// Additional ping samples are best effort, the query shouldn't fail due to them.
+	pings := []time.Duration{ping}
+	for len(pings) < protocol.PingSamples(req) {
+		token, rtt, err := mc.handshake(transport, sessionId)
+		if err != nil {
+			break
+		}
+
+		challengeToken = token
+		pings = append(pings, rtt)
 	}
 
-	if responsePacket.ReadInt32() != sessionId {
-		return api.Response{}, errors.New("received handshake for wrong session id")
+	var responsePacket protocol.Packet
+	err = protocol.Retry(ctx, req, func(attempt int) error {
+		if attempt > 0 {
+			// The challenge token may have expired in the meantime, so start over with a fresh handshake.
+			var err error
+			sessionId = generateSessionID()
+			challengeToken, _, err = mc.handshake(transport, sessionId)
+			if err != nil {
+				return err
+			}
+		}
+
+		var err error
+		responsePacket, err = mc.stat(transport, sessionId, challengeToken)
+
+		return err
+	})
+	if err != nil {
+		return api.Response{}, err
 	}
 
 	responsePacket.Forward(11)
@@ -163,17 +246,32 @@ func (mc MinecraftUDP) Execute(helper internal.NetworkHelper) (api.Response, err
 	}
 
 	if responsePacket.IsInvalid() {
-		return api.Response{}, errors.New("received packet is invalid")
+		return api.Response{}, fmt.Errorf("%w: received packet is invalid", api.ErrMalformedResponse)
 	}
 
-	return api.Response{
+	var players []api.Player
+	for _, playerName := range raw.Players {
+		players = append(players, api.Player{
+			Name: playerName,
+		})
+	}
+
+	response := api.Response{
 		Name: raw.Hostname,
 		Players: api.PlayersResponse{
 			Current: int(raw.NumPlayers),
 			Max:     int(raw.MaxPlayers),
 			Names:   raw.Players,
+			List:    players,
 		},
 
+		Map:      raw.Map,
+		Version:  raw.Version,
+		GameType: raw.GameType,
+
 		Raw: raw,
-	}, nil
+	}
+	response.Ping, response.PingStats = protocol.Ping(pings)
+
+	return response, nil
 }
@@ -1,16 +1,28 @@
 package protocols
 
 import (
+	"bytes"
+	"compress/bzip2"
+	"context"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"github.com/wisp-gg/gamequery/api"
-	"github.com/wisp-gg/gamequery/internal"
+	"github.com/wisp-gg/gamequery/protocol"
+	"hash/crc32"
+	"io"
 	"sort"
+	"strings"
+	"time"
 )
 
 type SourceQuery struct{}
 
+// The Ship extends both the A2S_INFO and A2S_PLAYER responses. Its dedicated servers report the
+// multiplayer AppID (2400), though the single-player one (2420) is accepted too.
+func isTheShip(appID uint16) bool {
+	return appID == 2400 || appID == 2420
+}
+
 func (sq SourceQuery) Name() string {
 	return "source"
 }
@@ -31,6 +43,68 @@ func (sq SourceQuery) Network() string {
 	return "udp"
 }
 
+// Source replies can't be told apart by session, only by their simple (FF) or split (FE) response header.
+func (sq SourceQuery) MatchResponse(sent, received []byte) bool {
+	if len(sent) < 4 || len(received) < 4 || !bytes.Equal(sent[:4], []byte{0xFF, 0xFF, 0xFF, 0xFF}) {
+		return false
+	}
+
+	return bytes.Equal(received[1:4], []byte{0xFF, 0xFF, 0xFF}) && (received[0] == 0xFF || received[0] == 0xFE)
+}
+
+// Header format of split responses, which differs between the Source and GoldSource engines.
+type splitFormat uint8
+
+const (
+	splitFormatUnknown splitFormat = iota
+	splitFormatSource
+	splitFormatGoldSource
+)
+
+func (format splitFormat) String() string {
+	switch format {
+	case splitFormatSource:
+		return "source"
+	case splitFormatGoldSource:
+		return "goldsource"
+	}
+
+	return "unknown"
+}
+
+// Guesses the split header format of a packet from an unknown engine. The payload of the first packet starts
+// with the simple response header, otherwise the header's fields have to be plausible for the format.
+//
+// Source:     FE FF FF FF | ID (4) | total (1) | number (1) | size (2) | payload
+// GoldSource: FE FF FF FF | ID (4) | number << 4 | total (1) | payload
+func detectSplitFormat(buffer []byte) splitFormat {
+	simpleHeader := []byte{0xFF, 0xFF, 0xFF, 0xFF}
+	if len(buffer) >= 16 && bytes.Equal(buffer[12:16], simpleHeader) {
+		return splitFormatSource
+	}
+
+	if len(buffer) >= 13 && bytes.Equal(buffer[9:13], simpleHeader) {
+		return splitFormatGoldSource
+	}
+
+	if len(buffer) >= 12 {
+		total, number, size := buffer[8], buffer[9], binary.LittleEndian.Uint16(buffer[10:12])
+		if number < total && size > 0 && size <= 2048 {
+			return splitFormatSource
+		}
+	}
+
+	if len(buffer) >= 9 {
+		number, total := buffer[8]>>4, buffer[8]&0x0F
+		if number < total {
+			return splitFormatGoldSource
+		}
+	}
+
+	// Modern servers are far more common, so that's the best guess.
+	return splitFormatSource
+}
+
 type partialPacket struct {
 	ID     int32
 	Number int8
@@ -38,38 +112,81 @@ type partialPacket struct {
 	Data   []byte
 }
 
-func (sq SourceQuery) handleMultiplePackets(helper internal.NetworkHelper, initialPacket internal.Packet) (internal.Packet, error) {
+// Receives the remaining packets of a split response and reassembles them. The split format is detected
+// from the first packet unless it's already known, and remembered for the following responses.
+// Late packets of previous (retransmitted) exchanges are skipped, as are duplicates.
+func (sq SourceQuery) handleMultiplePackets(transport protocol.Transport, initialPacket protocol.Packet, format *splitFormat) (protocol.Packet, error) {
 	var initial = true
 	var curPacket = initialPacket
 	var packets []partialPacket
+	var responseId int32
+	var seen = make(map[int8]bool)
 	var compressed = false
-	var decompressedSize, crc32 int32 = 0, 0
+	var decompressedSize, checksum uint32 = 0, 0
 	for {
 		if !initial {
 			var err error
-			curPacket, err = helper.Receive()
+			curPacket, err = transport.Receive()
 			if err != nil {
-				return internal.Packet{}, err
+				return protocol.Packet{}, err
 			}
 
 			curPacket.SetOrder(binary.LittleEndian)
 		}
 
-		if curPacket.ReadInt32() != -2 {
-			return internal.Packet{}, errors.New("received packet isn't part of split response")
+		if *format == splitFormatUnknown {
+			*format = detectSplitFormat(curPacket.GetBuffer())
+			transport.Logger().Debug("gamequery: detected split packet format", "format", format.String())
+		}
+
+		packetType := curPacket.ReadInt32()
+		if packetType == -1 && !initial {
+			transport.Logger().Debug("gamequery: skipping stale simple response during split response")
+
+			continue
+		}
+
+		if packetType != -2 {
+			return protocol.Packet{}, fmt.Errorf("%w: received packet isn't part of split response", api.ErrMalformedResponse)
+		}
+
+		var id = curPacket.ReadInt32()
+		var total, number int8
+		var size uint16
+		if *format == splitFormatGoldSource {
+			packetInfo := curPacket.ReadUint8()
+			number, total = int8(packetInfo>>4), int8(packetInfo&0x0F)
+		} else {
+			total, number, size = curPacket.ReadInt8(), curPacket.ReadInt8(), curPacket.ReadUint16()
 		}
 
-		// For the sake of simplicity, we'll assume that the server is Source based instead of possibly Goldsource.
-		id, total, number, size := curPacket.ReadInt32(), curPacket.ReadInt8(), curPacket.ReadInt8(), curPacket.ReadUint16()
 		if initial {
-			compressed = uint32(id)&0x80000000 != 0
+			responseId = id
+		} else if id != responseId {
+			transport.Logger().Debug("gamequery: skipping split packet of another response", "id", id, "wanted", responseId)
 
-			if compressed {
-				decompressedSize, crc32 = curPacket.ReadInt32(), curPacket.ReadInt32()
-			}
+			continue
+		}
 
-			initial = false
+		if seen[number] {
+			transport.Logger().Debug("gamequery: skipping duplicate split packet", "id", id, "number", number)
+
+			continue
+		}
+		seen[number] = true
+
+		// Only Source supports compression, with the size and checksum of the decompressed response
+		// following the header of the first packet.
+		if *format == splitFormatSource && uint32(id)&0x80000000 != 0 {
+			compressed = true
+
+			if number == 0 {
+				decompressedSize, checksum = curPacket.ReadUint32(), curPacket.ReadUint32()
+			}
 		}
+		initial = false
+
+		transport.Logger().Debug("gamequery: received split packet", "id", id, "number", number, "total", total, "size", size)
 
 		packets = append(packets, partialPacket{
 			ID:     id,
@@ -79,7 +196,7 @@ func (sq SourceQuery) handleMultiplePackets(helper internal.NetworkHelper, initi
 		})
 
 		if curPacket.IsInvalid() {
-			return internal.Packet{}, errors.New("split packet response was malformed")
+			return protocol.Packet{}, fmt.Errorf("%w: split packet response was malformed", api.ErrMalformedResponse)
 		}
 
 		if len(packets) == int(total) {
@@ -91,16 +208,24 @@ func (sq SourceQuery) handleMultiplePackets(helper internal.NetworkHelper, initi
 		return packets[i].Number < packets[j].Number
 	})
 
-	packet := internal.Packet{}
+	packet := protocol.Packet{}
 	packet.SetOrder(binary.LittleEndian)
 	for _, partial := range packets {
 		packet.WriteRaw(partial.Data...)
 	}
 
+	transport.Logger().Debug("gamequery: reassembled split packets", "packets", len(packets), "size", packet.Length(), "compressed", compressed)
+
 	if compressed {
-		// TODO: Handle decompression (only engines from ~2006-era seem to implement this)
+		data, err := decompress(packet.GetBuffer(), decompressedSize, checksum)
+		if err != nil {
+			return protocol.Packet{}, err
+		}
+
+		transport.Logger().Debug("gamequery: decompressed split packets", "size", len(data))
 
-		return internal.Packet{}, errors.New("received packet that is bz2 compressed (" + string(decompressedSize) + ", " + string(crc32) + ")")
+		packet.Clear()
+		packet.WriteRaw(data...)
 	}
 
 	// The constructed packet will resemble the simple response format, so we need to get rid of
@@ -110,7 +235,35 @@ func (sq SourceQuery) handleMultiplePackets(helper internal.NetworkHelper, initi
 	return packet, nil
 }
 
-func (sq SourceQuery) handleReceivedPacket(helper internal.NetworkHelper, packet internal.Packet) (internal.Packet, error) {
+// Upper bound of the decompressed size, as the announced one can't be trusted.
+const maxDecompressedSize = 1 << 20
+
+// Decompresses the bzip2 compressed response, verifying its announced size and CRC32 checksum.
+func decompress(data []byte, size uint32, checksum uint32) ([]byte, error) {
+	if size > maxDecompressedSize {
+		return nil, fmt.Errorf("%w: announced decompressed size %d is too large", api.ErrMalformedResponse, size)
+	}
+
+	// Reading past the announced size tells a too large response apart.
+	decompressed, err := io.ReadAll(io.LimitReader(bzip2.NewReader(bytes.NewReader(data)), int64(size)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decompress response: %s", api.ErrMalformedResponse, err)
+	}
+
+	actualChecksum := crc32.ChecksumIEEE(decompressed)
+	if uint32(len(decompressed)) != size || actualChecksum != checksum {
+		return nil, &api.ChecksumError{
+			Size:           size,
+			ActualSize:     uint32(len(decompressed)),
+			Checksum:       checksum,
+			ActualChecksum: actualChecksum,
+		}
+	}
+
+	return decompressed, nil
+}
+
+func (sq SourceQuery) handleReceivedPacket(transport protocol.Transport, packet protocol.Packet, format *splitFormat) (protocol.Packet, error) {
 	packetType := packet.ReadInt32()
 	if packetType == -1 {
 		return packet, nil
@@ -119,59 +272,184 @@ func (sq SourceQuery) handleReceivedPacket(helper internal.NetworkHelper, packet
 	if packetType == -2 {
 		packet.Forward(-4) // Seek back so we're able to reread the data in handleMultiplePackets
 
-		return sq.handleMultiplePackets(helper, packet)
+		return sq.handleMultiplePackets(transport, packet, format)
 	}
 
-	return internal.Packet{}, errors.New(fmt.Sprintf("unable to handle unknown packet type %d", packetType))
+	return protocol.Packet{}, fmt.Errorf("%w: unable to handle unknown packet type %d", api.ErrMalformedResponse, packetType)
 }
 
-func (sq SourceQuery) request(helper internal.NetworkHelper, requestPacket internal.Packet, wantedId uint8, allowChallengeRequest bool) (internal.Packet, error) {
-	if err := helper.Send(requestPacket.GetBuffer()); err != nil {
-		return internal.Packet{}, err
+// Sends the request and returns the wanted response along with the round trip time of the exchange
+// which produced it (after the challenge, if one was required).
+func (sq SourceQuery) request(transport protocol.Transport, format *splitFormat, requestPacket protocol.Packet, wantedId uint8, allowChallengeRequest bool) (protocol.Packet, time.Duration, error) {
+	sentAt := time.Now()
+	if err := transport.Send(requestPacket.GetBuffer()); err != nil {
+		return protocol.Packet{}, 0, err
 	}
 
-	packet, err := helper.Receive()
-	if err != nil {
-		return internal.Packet{}, err
+	for {
+		packet, err := transport.Receive()
+		if err != nil {
+			return protocol.Packet{}, 0, err
+		}
+		rtt := time.Since(sentAt)
+
+		packet.SetOrder(binary.LittleEndian)
+		packet, err = sq.handleReceivedPacket(transport, packet, format)
+		if err != nil {
+			return protocol.Packet{}, 0, err
+		}
+
+		responseType := packet.ReadUint8()
+		if responseType == wantedId {
+			return packet, rtt, nil
+		}
+
+		if responseType != 0x41 {
+			// Late replies to the requests of previous (retransmitted) exchanges are skipped.
+			if isSourceResponseType(responseType) {
+				// Only GoldSource servers send the obsolete info response.
+				if responseType == 0x6D && *format == splitFormatUnknown {
+					*format = splitFormatGoldSource
+				}
+
+				transport.Logger().Debug("gamequery: skipping stale response", "type", responseType, "wanted", wantedId)
+
+				continue
+			}
+
+			return protocol.Packet{}, 0, fmt.Errorf("%w: unable to handle unknown response type %d", api.ErrMalformedResponse, responseType)
+		}
+
+		challenge := packet.ReadInt32()
+
+		// If a challenge response fails, the game may respond with another challenge.
+		// To avoid a recursive loop, we explicitly disallow requesting new challenges after
+		// a single challenge request has been done (initial request).
+		if !allowChallengeRequest {
+			// Though a duplicate of the challenge we've already answered is just a late reply of a retransmission.
+			if challenge == sentChallenge(requestPacket) {
+				transport.Logger().Debug("gamequery: skipping duplicate challenge", "challenge", challenge)
+
+				continue
+			}
+
+			return protocol.Packet{}, 0, fmt.Errorf("%w: unable to handle response due to disallowing challenge requests", api.ErrMalformedResponse)
+		}
+
+		transport.Logger().Debug("gamequery: received challenge, resending request", "challenge", challenge, "wanted", wantedId)
+
+		challengedRequest := protocol.Packet{}
+		challengedRequest.SetOrder(binary.LittleEndian)
+		challengedRequest.WriteInt32(requestPacket.ReadInt32())
+		challengedRequest.WriteUint8(requestPacket.ReadUint8())
+		if wantedId == 0x49 {
+			challengedRequest.WriteString("Source Engine Query")
+			challengedRequest.WriteRaw(0x00)
+		}
+		challengedRequest.WriteInt32(challenge)
+
+		return sq.request(transport, format, challengedRequest, wantedId, false)
 	}
+}
 
-	packet.SetOrder(binary.LittleEndian)
-	packet, err = sq.handleReceivedPacket(helper, packet)
-	if err != nil {
-		return internal.Packet{}, err
+// Same as request, but retransmits the request (starting over from the unchallenged one) according to the retry policy.
+func (sq SourceQuery) exchange(ctx context.Context, req api.Request, transport protocol.Transport, format *splitFormat, requestPacket protocol.Packet, wantedId uint8) (protocol.Packet, time.Duration, error) {
+	var packet protocol.Packet
+	var rtt time.Duration
+	err := protocol.Retry(ctx, req, func(attempt int) error {
+		var err error
+		packet, rtt, err = sq.request(transport, format, requestPacket, wantedId, true)
+
+		return err
+	})
+
+	return packet, rtt, err
+}
+
+// Returns the challenge a challenged request ends with.
+func sentChallenge(requestPacket protocol.Packet) int32 {
+	buffer := requestPacket.GetBuffer()
+	if len(buffer) < 4 {
+		return 0
 	}
 
-	responseType := packet.ReadUint8()
-	if responseType == wantedId {
-		return packet, nil
+	return int32(binary.LittleEndian.Uint32(buffer[len(buffer)-4:]))
+}
+
+// GoldSource servers report network protocol 48, and the AppIDs of GoldSource games are all below 200.
+func isGoldSource(info api.SourceQuery_A2SInfo) bool {
+	// The ID only holds the lower 16 bits of the AppID, while the extra data's game ID holds the full one.
+	appID := uint64(info.ID)
+	if (info.EDF & 0x01) != 0 {
+		appID = info.ExtraData.GameID & 0xFFFFFF
+	}
+
+	return info.Protocol == 48 || (appID != 0 && appID < 200)
+}
+
+func isSourceResponseType(responseType uint8) bool {
+	switch responseType {
+	case 0x49, 0x6D, 0x44, 0x45:
+		return true
 	}
 
-	if responseType != 0x41 {
-		return internal.Packet{}, errors.New(fmt.Sprintf("unable to handle unknown response type %d", responseType))
+	return false
+}
+
+func serverOS(environment uint8) string {
+	switch environment {
+	case 'l':
+		return "linux"
+	case 'w':
+		return "windows"
+	case 'm', 'o':
+		return "mac"
+	}
+
+	return ""
+}
+
+func splitKeywords(keywords string) []string {
+	var tags []string
+	for _, tag := range strings.Split(keywords, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
 	}
 
-	// If a challenge response fails, the game may respond with another challenge.
-	// To avoid a recursive loop, we explicitly disallow requesting new challenges after
-	// a single challenge request has been done (initial request).
-	if !allowChallengeRequest {
-		return internal.Packet{}, errors.New("unable to handle response due to disallowing challenge requests")
+	return tags
+}
+
+// Requests the server's rules (A2S_RULES).
+func (sq SourceQuery) rules(ctx context.Context, req api.Request, transport protocol.Transport, format *splitFormat) (map[string]string, error) {
+	requestPacket := protocol.Packet{}
+	requestPacket.SetOrder(binary.LittleEndian)
+	requestPacket.WriteRaw(0xFF, 0xFF, 0xFF, 0xFF, 0x56, 0xFF, 0xFF, 0xFF, 0xFF)
+
+	packet, _, err := sq.exchange(ctx, req, transport, format, requestPacket, 0x45)
+	if err != nil {
+		return nil, err
 	}
 
-	challengedRequest := internal.Packet{}
-	challengedRequest.SetOrder(binary.LittleEndian)
-	challengedRequest.WriteInt32(requestPacket.ReadInt32())
-	challengedRequest.WriteUint8(requestPacket.ReadUint8())
-	if wantedId == 0x49 {
-		challengedRequest.WriteString("Source Engine Query")
-		challengedRequest.WriteRaw(0x00)
+	count := packet.ReadUint16()
+	rules := make(map[string]string, count)
+	for i := 0; i < int(count) && !packet.ReachedEnd(); i++ {
+		name, value := packet.ReadString(), packet.ReadString()
+		if packet.IsInvalid() {
+			return nil, fmt.Errorf("%w: received rules packet is invalid", api.ErrMalformedResponse)
+		}
+
+		rules[name] = value
 	}
-	challengedRequest.WriteInt32(packet.ReadInt32())
 
-	return sq.request(helper, challengedRequest, wantedId, false)
+	return rules, nil
 }
 
-func (sq SourceQuery) Execute(helper internal.NetworkHelper) (api.Response, error) {
-	requestPacket := internal.Packet{}
+func (sq SourceQuery) Execute(ctx context.Context, req api.Request, transport protocol.Transport) (api.Response, error) {
+	// The engine (and thus the split packet format) isn't known until the info response tells it.
+	var format = splitFormatUnknown
+
+	requestPacket := protocol.Packet{}
 	requestPacket.SetOrder(binary.LittleEndian)
 
 	// A2S_INFO request
@@ -179,7 +457,7 @@ func (sq SourceQuery) Execute(helper internal.NetworkHelper) (api.Response, erro
 	requestPacket.WriteString("Source Engine Query")
 	requestPacket.WriteRaw(0x00)
 
-	packet, err := sq.request(helper, requestPacket, 0x49, true)
+	packet, ping, err := sq.exchange(ctx, req, transport, &format, requestPacket, 0x49)
 	if err != nil {
 		return api.Response{}, err
 	}
@@ -200,8 +478,8 @@ func (sq SourceQuery) Execute(helper internal.NetworkHelper) (api.Response, erro
 		VAC:         packet.ReadUint8(),
 	}
 
-	if raw.ID == 2420 {
-		return api.Response{}, errors.New("detected The Ship response, unsupported")
+	if isTheShip(raw.ID) {
+		raw.Mode, raw.Witnesses, raw.Duration = packet.ReadUint8(), packet.ReadUint8(), packet.ReadUint8()
 	}
 
 	raw.Version = packet.ReadString()
@@ -235,7 +513,22 @@ func (sq SourceQuery) Execute(helper internal.NetworkHelper) (api.Response, erro
 	}
 
 	if packet.IsInvalid() {
-		return api.Response{}, errors.New("received packet is invalid")
+		return api.Response{}, fmt.Errorf("%w: received packet is invalid", api.ErrMalformedResponse)
+	}
+
+	if format == splitFormatUnknown && isGoldSource(raw) {
+		format = splitFormatGoldSource
+	}
+
+	// Additional ping samples are best effort, the query shouldn't fail due to them.
+	pings := []time.Duration{ping}
+	for len(pings) < protocol.PingSamples(req) {
+		_, rtt, err := sq.request(transport, &format, requestPacket, 0x49, true)
+		if err != nil {
+			break
+		}
+
+		pings = append(pings, rtt)
 	}
 
 	// Attempt to additionally get info from A2S_PLAYER (as it contains player names)
@@ -246,12 +539,22 @@ func (sq SourceQuery) Execute(helper internal.NetworkHelper) (api.Response, erro
 	requestPacket.Clear()
 	requestPacket.WriteRaw(0xFF, 0xFF, 0xFF, 0xFF, 0x55, 0xFF, 0xFF, 0xFF, 0xFF)
 
-	packet, err = sq.request(helper, requestPacket, 0x44, true)
-	var playerList []string
+	packet, _, err = sq.exchange(ctx, req, transport, &format, requestPacket, 0x44)
+	if err != nil && ctx.Err() != nil {
+		// Missing player info is fine, but a cancelled query shouldn't be reported as a success.
+		return api.Response{}, ctx.Err()
+	}
+
+	var rawPlayers []api.SourceQuery_A2SPlayer
 	if err == nil {
-		packet.ReadUint8() // Number of players we received information for
+		count := packet.ReadUint8() // Number of players we received information for
 
 		for {
+			// The Ship's extra player data follows the player records, so they can't just be read until the end.
+			if isTheShip(raw.ID) && len(rawPlayers) == int(count) {
+				break
+			}
+
 			player := api.SourceQuery_A2SPlayer{
 				Index:    packet.ReadUint8(),
 				Name:     packet.ReadString(),
@@ -263,22 +566,67 @@ func (sq SourceQuery) Execute(helper internal.NetworkHelper) (api.Response, erro
 				break
 			}
 
-			playerList = append(playerList, player.Name)
+			rawPlayers = append(rawPlayers, player)
 
 			if packet.ReachedEnd() {
 				break
 			}
 		}
+
+		if isTheShip(raw.ID) {
+			for i := range rawPlayers {
+				rawPlayers[i].Deaths, rawPlayers[i].Money = packet.ReadInt32(), packet.ReadInt32()
+			}
+		}
+	}
+
+	var playerList []string
+	var players []api.Player
+	for _, player := range rawPlayers {
+		playerList = append(playerList, player.Name)
+		players = append(players, api.Player{
+			Name:     player.Name,
+			Score:    int(player.Score),
+			Duration: time.Duration(float64(player.Duration) * float64(time.Second)),
+		})
+	}
+
+	var rules map[string]string
+	if req.Rules {
+		// Same as with A2S_PLAYER, missing rules are acceptable (plenty of servers have them disabled).
+		rules, err = sq.rules(ctx, req, transport, &format)
+		if err != nil && ctx.Err() != nil {
+			return api.Response{}, ctx.Err()
+		} else if err != nil {
+			transport.Logger().Debug("gamequery: A2S_RULES request failed", "error", err)
+		}
 	}
 
-	return api.Response{
+	response := api.Response{
 		Name: raw.Name,
 		Players: api.PlayersResponse{
 			Current: int(raw.Players),
 			Max:     int(raw.MaxPlayers),
 			Names:   playerList,
+			List:    players,
+		},
+
+		Map:        raw.Map,
+		Version:    raw.Version,
+		GameType:   raw.Game,
+		Passworded: raw.Visibility == 1,
+		Bots:       int(raw.Bots),
+		Secure:     raw.VAC == 1,
+		ServerOS:   serverOS(raw.Environment),
+		Tags:       splitKeywords(raw.ExtraData.Keywords),
+
+		Raw: api.SourceQueryRaw{
+			Info:    raw,
+			Players: rawPlayers,
+			Rules:   rules,
 		},
+	}
+	response.Ping, response.PingStats = protocol.Ping(pings)
 
-		Raw: raw,
-	}, nil
+	return response, nil
 }
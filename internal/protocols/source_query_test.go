@@ -0,0 +1,198 @@
+package protocols
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/wisp-gg/gamequery/api"
+	"github.com/wisp-gg/gamequery/protocol"
+	"testing"
+)
+
+// Transport replaying the queued packets.
+type fakeTransport struct {
+	packets [][]byte
+}
+
+func (transport *fakeTransport) Send([]byte) error {
+	return nil
+}
+
+func (transport *fakeTransport) Receive() (protocol.Packet, error) {
+	if len(transport.packets) == 0 {
+		return protocol.Packet{}, api.ErrTimeout
+	}
+
+	packet := protocol.Packet{}
+	packet.SetBuffer(transport.packets[0])
+	transport.packets = transport.packets[1:]
+
+	return packet, nil
+}
+
+func (transport *fakeTransport) GetHost() string         { return "127.0.0.1" }
+func (transport *fakeTransport) GetIP() string           { return "127.0.0.1" }
+func (transport *fakeTransport) GetPort() uint16         { return 27015 }
+func (transport *fakeTransport) Logger() protocol.Logger { return protocol.NopLogger{} }
+
+func sourceSplitPacket(id uint32, total, number uint8, payload ...byte) []byte {
+	packet := []byte{0xFE, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0, total, number, 0xE0, 0x04}
+	binary.LittleEndian.PutUint32(packet[4:8], id)
+
+	return append(packet, payload...)
+}
+
+func goldSourceSplitPacket(id uint32, total, number uint8, payload ...byte) []byte {
+	packet := []byte{0xFE, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0, number<<4 | total}
+	binary.LittleEndian.PutUint32(packet[4:8], id)
+
+	return append(packet, payload...)
+}
+
+func TestDetectSplitFormat(t *testing.T) {
+	simpleHeader := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x45}
+	rule := []byte("sv_password\x000\x00")
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   splitFormat
+	}{
+		{"source first", sourceSplitPacket(7, 2, 0, simpleHeader...), splitFormatSource},
+		{"source non-first", sourceSplitPacket(7, 2, 1, rule...), splitFormatSource},
+		{"source compressed first", sourceSplitPacket(0x80000007, 2, 0, 0x15, 0, 0, 0, 0x50, 0xF5, 0x04, 0x29, 'B', 'Z', 'h'), splitFormatSource},
+		{"goldsource first", goldSourceSplitPacket(7, 2, 0, simpleHeader...), splitFormatGoldSource},
+		{"goldsource non-first", goldSourceSplitPacket(7, 2, 1, rule...), splitFormatGoldSource},
+		{"too short", []byte{0xFE, 0xFF, 0xFF, 0xFF}, splitFormatSource},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := detectSplitFormat(test.packet); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+// bzip2 compressed A2S_RULES response with the single rule sv_password=0.
+var compressedRules = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x83, 0xe2, 0x0b, 0x12, 0x00, 0x00,
+	0x0a, 0xcf, 0x80, 0xe0, 0x00, 0x40, 0x00, 0x02, 0x00, 0x00, 0x00, 0xa4, 0x00, 0xd9, 0x80, 0x00,
+	0x00, 0xa0, 0x00, 0x22, 0x00, 0x9a, 0x33, 0x28, 0x40, 0x00, 0x0e, 0x18, 0x9a, 0xa4, 0x19, 0xa7,
+	0x00, 0xb2, 0xa1, 0x5f, 0xe2, 0xee, 0x48, 0xa7, 0x0a, 0x12, 0x10, 0x7c, 0x41, 0x62, 0x40,
+}
+
+const (
+	compressedRulesSize     = 21
+	compressedRulesChecksum = 0x2904f550
+)
+
+func TestDecompress(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         []byte
+		size         uint32
+		checksum     uint32
+		wantChecksum bool // Expects a *api.ChecksumError
+		wantErr      bool // Expects any ErrMalformedResponse
+	}{
+		{name: "valid", data: compressedRules, size: compressedRulesSize, checksum: compressedRulesChecksum},
+		{name: "wrong checksum", data: compressedRules, size: compressedRulesSize, checksum: compressedRulesChecksum + 1, wantChecksum: true, wantErr: true},
+		{name: "announced size too small", data: compressedRules, size: compressedRulesSize - 1, checksum: compressedRulesChecksum, wantChecksum: true, wantErr: true},
+		{name: "announced size too large", data: compressedRules, size: compressedRulesSize + 1, checksum: compressedRulesChecksum, wantChecksum: true, wantErr: true},
+		{name: "size above the cap", data: compressedRules, size: maxDecompressedSize + 1, checksum: compressedRulesChecksum, wantErr: true},
+		{name: "not bzip2", data: []byte("not compressed at all"), size: compressedRulesSize, checksum: compressedRulesChecksum, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := decompress(test.data, test.size, test.checksum)
+
+			var checksumErr *api.ChecksumError
+			if got := errors.As(err, &checksumErr); got != test.wantChecksum {
+				t.Errorf("got error %v, want checksum error: %t", err, test.wantChecksum)
+			}
+
+			if got := errors.Is(err, api.ErrMalformedResponse); got != test.wantErr {
+				t.Errorf("got error %v, want malformed response: %t", err, test.wantErr)
+			}
+
+			if !test.wantErr && (len(data) != compressedRulesSize || !bytes.HasPrefix(data, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x45})) {
+				t.Errorf("got decompressed data %v", data)
+			}
+		})
+	}
+}
+
+func TestHandleMultiplePackets(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  splitFormat
+		packets [][]byte
+		want    string // The reassembled payload after the simple response header
+	}{
+		{
+			name:   "source out of order",
+			format: splitFormatUnknown,
+			packets: [][]byte{
+				sourceSplitPacket(7, 2, 1, 'l', 'd'),
+				sourceSplitPacket(7, 2, 0, 0xFF, 0xFF, 0xFF, 0xFF, 'w', 'o', 'r'),
+			},
+			want: "world",
+		},
+		{
+			name:   "goldsource",
+			format: splitFormatGoldSource,
+			packets: [][]byte{
+				goldSourceSplitPacket(7, 2, 0, 0xFF, 0xFF, 0xFF, 0xFF, 'w', 'o', 'r'),
+				goldSourceSplitPacket(7, 2, 1, 'l', 'd'),
+			},
+			want: "world",
+		},
+		{
+			name:   "stale and duplicate packets",
+			format: splitFormatSource,
+			packets: [][]byte{
+				sourceSplitPacket(7, 2, 0, 0xFF, 0xFF, 0xFF, 0xFF, 'w', 'o', 'r'),
+				sourceSplitPacket(6, 2, 1, 'X', 'X'),
+				{0xFF, 0xFF, 0xFF, 0xFF, 0x49},
+				sourceSplitPacket(7, 2, 0, 0xFF, 0xFF, 0xFF, 0xFF, 'X', 'X', 'X'),
+				sourceSplitPacket(7, 2, 1, 'l', 'd'),
+			},
+			want: "world",
+		},
+		{
+			name:   "compressed",
+			format: splitFormatSource,
+			packets: [][]byte{
+				sourceSplitPacket(0x80000007, 2, 1, compressedRules[30:]...),
+				sourceSplitPacket(0x80000007, 2, 0, append([]byte{0x15, 0, 0, 0, 0x50, 0xF5, 0x04, 0x29}, compressedRules[:30]...)...),
+			},
+			want: "\x45\x01\x00sv_password\x000\x00",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := &fakeTransport{packets: test.packets[1:]}
+			initial := protocol.Packet{}
+			initial.SetBuffer(test.packets[0])
+			initial.SetOrder(binary.LittleEndian)
+
+			format := test.format
+			packet, err := SourceQuery{}.handleMultiplePackets(transport, initial, &format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := string(packet.ReadRest()); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+
+			if len(transport.packets) != 0 {
+				t.Errorf("%d packets weren't received", len(transport.packets))
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/wisp-gg/gamequery/protocol"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	muxReadBufSize    = 65535
+	muxQueueSize      = 16
+	muxReadErrorDelay = 10 * time.Millisecond
+)
+
+// Reports whether the received datagram is a reply to the last one sent over the same connection.
+type ResponseMatcher func(sent, received []byte) bool
+
+// Shares a few unconnected UDP sockets between many queries, demultiplexing the replies by their
+// source address and the querying protocol's ResponseMatcher.
+//
+// A socket only carries a single query per protocol and remote address at a time (as replies of the same
+// protocol can't always be told apart), so queries exceeding that fall back to the other sockets,
+// and eventually to a dedicated socket.
+type UDPMux struct {
+	sockets []*muxSocket
+	next    uint32
+	bind    BindDialer
+}
+
+type muxSocket struct {
+	conn   net.PacketConn
+	logger protocol.Logger
+	mutex  sync.Mutex
+	conns  map[string][]*muxConn
+}
+
+// Opens the shared sockets, bound according to bind.
+func NewUDPMux(sockets int, bind BindDialer, logger protocol.Logger) (*UDPMux, error) {
+	if sockets < 1 {
+		sockets = 1
+	}
+
+	mux := &UDPMux{
+		bind: bind,
+	}
+	for i := 0; i < sockets; i++ {
+		conn, err := bind.ListenPacket()
+		if err != nil {
+			_ = mux.Close()
+			return nil, err
+		}
+
+		socket := &muxSocket{
+			conn:   conn,
+			logger: logger,
+			conns:  make(map[string][]*muxConn),
+		}
+		mux.sockets = append(mux.sockets, socket)
+
+		go socket.readLoop()
+	}
+
+	return mux, nil
+}
+
+// Returns a dialer for UDP connections over the shared sockets on behalf of the given protocol.
+// The matcher may be nil, in which case the protocol's queries don't share a remote address with any other query.
+func (mux *UDPMux) Dialer(protocolName string, matcher ResponseMatcher) protocol.Dialer {
+	return muxDialer{
+		mux:          mux,
+		protocolName: protocolName,
+		matcher:      matcher,
+	}
+}
+
+// Closes the shared sockets along with the connections still using them, unblocking their reads.
+func (mux *UDPMux) Close() error {
+	var firstErr error
+	for _, socket := range mux.sockets {
+		if err := socket.conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		socket.mutex.Lock()
+		var conns []*muxConn
+		for _, keyConns := range socket.conns {
+			conns = append(conns, keyConns...)
+		}
+		socket.mutex.Unlock()
+
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+
+	return firstErr
+}
+
+type muxDialer struct {
+	mux          *UDPMux
+	protocolName string
+	matcher      ResponseMatcher
+}
+
+func (dialer muxDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	remoteAddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &muxConn{
+		protocolName: dialer.protocolName,
+		matcher:      dialer.matcher,
+		remoteAddr:   remoteAddr,
+		packets:      make(chan []byte, muxQueueSize),
+		closed:       make(chan struct{}),
+	}
+
+	start := atomic.AddUint32(&dialer.mux.next, 1)
+	for i := range dialer.mux.sockets {
+		socket := dialer.mux.sockets[(int(start)+i)%len(dialer.mux.sockets)]
+		if socket.register(conn) {
+			return conn, nil
+		}
+	}
+
+	return dialer.mux.bind.DialContext(ctx, network, address)
+}
+
+func muxKey(addr *net.UDPAddr) string {
+	return net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+}
+
+func (socket *muxSocket) register(conn *muxConn) bool {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+
+	key := muxKey(conn.remoteAddr)
+	for _, existing := range socket.conns[key] {
+		if existing.protocolName == conn.protocolName || existing.matcher == nil || conn.matcher == nil {
+			return false
+		}
+	}
+
+	conn.socket = socket
+	socket.conns[key] = append(socket.conns[key], conn)
+
+	return true
+}
+
+func (socket *muxSocket) unregister(conn *muxConn) {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+
+	key := muxKey(conn.remoteAddr)
+	conns := socket.conns[key]
+	for index, existing := range conns {
+		if existing == conn {
+			conns = append(conns[:index], conns[index+1:]...)
+			break
+		}
+	}
+
+	if len(conns) == 0 {
+		delete(socket.conns, key)
+	} else {
+		socket.conns[key] = conns
+	}
+}
+
+func (socket *muxSocket) readLoop() {
+	buf := make([]byte, muxReadBufSize)
+	for {
+		size, addr, err := socket.conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+
+		// Other errors (e.g. ICMP errors reported on some platforms) don't affect the socket's other queries.
+		if err != nil {
+			socket.logger.Debug("gamequery: shared UDP socket read failed", "address", socket.conn.LocalAddr().String(), "error", err)
+
+			time.Sleep(muxReadErrorDelay)
+			continue
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		data := make([]byte, size)
+		copy(data, buf[:size])
+
+		socket.dispatch(udpAddr, data)
+	}
+}
+
+// Hands the datagram to the first connection of its source address accepting it, otherwise it's dropped.
+func (socket *muxSocket) dispatch(addr *net.UDPAddr, data []byte) {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+
+	for _, conn := range socket.conns[muxKey(addr)] {
+		if conn.matcher != nil && !conn.matcher(conn.getLastSent(), data) {
+			continue
+		}
+
+		select {
+		case conn.packets <- data:
+		default:
+			// The query isn't keeping up with the replies, drop the datagram like the kernel would.
+		}
+		return
+	}
+}
+
+type muxConn struct {
+	protocolName string
+	matcher      ResponseMatcher
+	socket       *muxSocket
+	remoteAddr   *net.UDPAddr
+
+	packets   chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mutex        sync.Mutex
+	lastSent     []byte
+	readDeadline time.Time
+}
+
+type muxTimeoutError struct{}
+
+func (muxTimeoutError) Error() string   { return "i/o timeout" }
+func (muxTimeoutError) Timeout() bool   { return true }
+func (muxTimeoutError) Temporary() bool { return true }
+
+func (conn *muxConn) getLastSent() []byte {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	return conn.lastSent
+}
+
+func (conn *muxConn) Read(b []byte) (int, error) {
+	conn.mutex.Lock()
+	deadline := conn.readDeadline
+	conn.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case data := <-conn.packets:
+		// Like with a regular UDP socket, the part of the datagram not fitting into b is discarded.
+		return copy(b, data), nil
+	case <-timeout:
+		return 0, &net.OpError{Op: "read", Net: "udp", Addr: conn.remoteAddr, Err: muxTimeoutError{}}
+	case <-conn.closed:
+		return 0, &net.OpError{Op: "read", Net: "udp", Addr: conn.remoteAddr, Err: net.ErrClosed}
+	}
+}
+
+func (conn *muxConn) Write(b []byte) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: conn.remoteAddr, Err: net.ErrClosed}
+	default:
+	}
+
+	sent := make([]byte, len(b))
+	copy(sent, b)
+
+	conn.mutex.Lock()
+	conn.lastSent = sent
+	conn.mutex.Unlock()
+
+	return conn.socket.conn.WriteTo(b, conn.remoteAddr)
+}
+
+func (conn *muxConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+		conn.socket.unregister(conn)
+	})
+
+	return nil
+}
+
+func (conn *muxConn) LocalAddr() net.Addr {
+	return conn.socket.conn.LocalAddr()
+}
+
+func (conn *muxConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func (conn *muxConn) SetDeadline(t time.Time) error {
+	return conn.SetReadDeadline(t)
+}
+
+// The deadline is only applied to subsequent Read calls, which is all NetworkHelper needs.
+func (conn *muxConn) SetReadDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.readDeadline = t
+	return nil
+}
+
+// Writes to an unconnected UDP socket don't block, so there's nothing to bound.
+func (conn *muxConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/wisp-gg/gamequery/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+// UDP server on the loopback interface replying to every datagram with "<datagram> reply",
+// except for datagrams starting with "silent".
+func udpReplyServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			size, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			if bytes.HasPrefix(buf[:size], []byte("silent")) {
+				continue
+			}
+
+			_, _ = conn.WriteTo(append(buf[:size:size], " reply"...), addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func testMux(t *testing.T, sockets int) *UDPMux {
+	mux, err := NewUDPMux(sockets, BindDialer{IP: net.IPv4(127, 0, 0, 1)}, protocol.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = mux.Close() })
+
+	return mux
+}
+
+// Matches replies starting with the same byte as the datagram sent.
+func prefixMatcher(sent, received []byte) bool {
+	return len(sent) > 0 && len(received) > 0 && sent[0] == received[0]
+}
+
+func dialMux(t *testing.T, mux *UDPMux, protocolName string, matcher ResponseMatcher, address string) net.Conn {
+	conn, err := mux.Dialer(protocolName, matcher).DialContext(context.Background(), "udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+func exchange(t *testing.T, conn net.Conn, payload string) string {
+	if _, err := conn.Write([]byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	buf := make([]byte, 1500)
+	size, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(buf[:size])
+}
+
+func TestUDPMuxProtocolsShareSocket(t *testing.T) {
+	address := udpReplyServer(t)
+	mux := testMux(t, 1)
+
+	first := dialMux(t, mux, "first", prefixMatcher, address)
+	second := dialMux(t, mux, "second", prefixMatcher, address)
+
+	if first.LocalAddr().String() != second.LocalAddr().String() {
+		t.Fatalf("got local addresses %s and %s, want the shared socket", first.LocalAddr(), second.LocalAddr())
+	}
+
+	// Both queries are in flight before either reply is read.
+	if _, err := first.Write([]byte("A query")); err != nil {
+		t.Fatal(err)
+	}
+	if got := exchange(t, second, "B query"); got != "B query reply" {
+		t.Errorf("second got %q", got)
+	}
+
+	buf := make([]byte, 1500)
+	_ = first.SetReadDeadline(time.Now().Add(time.Second))
+	size, err := first.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:size]); got != "A query reply" {
+		t.Errorf("first got %q", got)
+	}
+}
+
+func TestUDPMuxDuplicateQueryFallsBack(t *testing.T) {
+	tests := []struct {
+		name       string
+		sockets    int
+		matcher    ResponseMatcher
+		wantShared bool // Whether the duplicate query still uses one of the shared sockets
+	}{
+		{name: "other shared socket", sockets: 2, matcher: prefixMatcher, wantShared: true},
+		{name: "dedicated socket", sockets: 1, matcher: prefixMatcher},
+		{name: "no matcher", sockets: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address := udpReplyServer(t)
+			mux := testMux(t, test.sockets)
+
+			first := dialMux(t, mux, "first", test.matcher, address)
+			duplicate := dialMux(t, mux, "first", test.matcher, address)
+
+			if first.LocalAddr().String() == duplicate.LocalAddr().String() {
+				t.Fatalf("both queries use %s", first.LocalAddr())
+			}
+
+			shared := false
+			for _, socket := range mux.sockets {
+				shared = shared || socket.conn.LocalAddr().String() == duplicate.LocalAddr().String()
+			}
+			if shared != test.wantShared {
+				t.Errorf("got shared socket: %t, want %t", shared, test.wantShared)
+			}
+
+			if got := exchange(t, first, "A first"); got != "A first reply" {
+				t.Errorf("first got %q", got)
+			}
+			if got := exchange(t, duplicate, "A duplicate"); got != "A duplicate reply" {
+				t.Errorf("duplicate got %q", got)
+			}
+		})
+	}
+}
+
+func TestUDPMuxReadTimeout(t *testing.T) {
+	conn := dialMux(t, testMux(t, 1), "first", prefixMatcher, udpReplyServer(t))
+
+	if _, err := conn.Write([]byte("silent")); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	var netErr net.Error
+	if _, err := conn.Read(make([]byte, 1500)); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("got error %v, want a timeout", err)
+	}
+}
+
+func TestUDPMuxCloseUnblocksRead(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(mux *UDPMux, conn net.Conn) error
+	}{
+		{name: "connection", close: func(_ *UDPMux, conn net.Conn) error { return conn.Close() }},
+		{name: "mux", close: func(mux *UDPMux, _ net.Conn) error { return mux.Close() }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mux := testMux(t, 1)
+			conn := dialMux(t, mux, "first", prefixMatcher, udpReplyServer(t))
+
+			result := make(chan error, 1)
+			go func() {
+				_, err := conn.Read(make([]byte, 1500))
+				result <- err
+			}()
+
+			time.Sleep(20 * time.Millisecond)
+			if err := test.close(mux, conn); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case err := <-result:
+				if !errors.Is(err, net.ErrClosed) {
+					t.Errorf("got error %v, want net.ErrClosed", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Read didn't return after Close")
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+package protocol
+
+import (
+	"context"
+	"net"
+)
+
+// Establishes the connections used for querying game servers, *net.Dialer satisfies this interface.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
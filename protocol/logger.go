@@ -0,0 +1,11 @@
+package protocol
+
+// Receives the library's diagnostic messages as key/value pairs, *slog.Logger satisfies this interface.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+}
+
+// Logger discarding every message.
+type NopLogger struct{}
+
+func (NopLogger) Debug(string, ...interface{}) {}
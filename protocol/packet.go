@@ -1,10 +1,12 @@
-package internal
+package protocol
 
 import (
 	"encoding/binary"
 	"math"
 )
 
+// Reader and writer for binary packets. The byte order has to be set with SetOrder before
+// reading or writing any multi-byte values.
 type Packet struct {
 	buffer  []byte
 	pos     int
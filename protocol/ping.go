@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"github.com/wisp-gg/gamequery/api"
+	"time"
+)
+
+// Amount of round trips a protocol should measure for the request's ping, always at least 1.
+func PingSamples(req api.Request) int {
+	if req.PingSamples < 1 {
+		return 1
+	}
+
+	return req.PingSamples
+}
+
+// Summarizes the measured round trips into the response's Ping and PingStats fields.
+// The ping is the average of the samples, and the stats are only present with more than one sample.
+func Ping(samples []time.Duration) (time.Duration, *api.PingStats) {
+	if len(samples) == 0 {
+		return 0, nil
+	}
+
+	stats := api.PingStats{
+		Samples: len(samples),
+		Min:     samples[0],
+		Max:     samples[0],
+	}
+
+	var total time.Duration
+	for _, sample := range samples {
+		if sample < stats.Min {
+			stats.Min = sample
+		}
+
+		if sample > stats.Max {
+			stats.Max = sample
+		}
+
+		total += sample
+	}
+	stats.Avg = total / time.Duration(len(samples))
+
+	if len(samples) == 1 {
+		return stats.Avg, nil
+	}
+
+	return stats.Avg, &stats
+}
@@ -0,0 +1,34 @@
+// Package protocol contains the building blocks for implementing game query protocols,
+// which can be registered with `gamequery.RegisterProtocol`.
+package protocol
+
+import (
+	"context"
+	"github.com/wisp-gg/gamequery/api"
+)
+
+// A game query protocol.
+type Protocol interface {
+	Name() string      // Unique name of the protocol, used as api.Request.Game in `gamequery.Query`
+	Aliases() []string // Alternative names for the protocol (multiple protocols can share the same alias)
+	DefaultPort() uint16
+	Priority() uint16 // Protocols with higher priority are preferred by `gamequery.Detect`
+	Network() string  // The network used by the protocol, either "tcp" or "udp"
+
+	// Queries the game server over the already established transport, req contains the original request's options.
+	Execute(ctx context.Context, req api.Request, transport Transport) (api.Response, error)
+}
+
+// Optionally implemented by UDP protocols, allowing their queries to share sockets with the queries
+// of other protocols to the same server (see `gamequery.WithSharedUDP`).
+type ResponseMatcher interface {
+	// Reports whether the received datagram is a reply to the last datagram sent by the same query.
+	MatchResponse(sent, received []byte) bool
+}
+
+// Optionally implemented by protocols whose servers can be located with DNS SRV records,
+// which are looked up when the request has a hostname but no port.
+type SRVProtocol interface {
+	// Returns the service and protocol of the SRV record, e.g. "minecraft" and "tcp" for _minecraft._tcp.
+	SRVService() (service, proto string)
+}
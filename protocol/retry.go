@@ -0,0 +1,57 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"github.com/wisp-gg/gamequery/api"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Calls exchange until it succeeds or the request's retry policy runs out of attempts, waiting the policy's
+// backoff in between. Only timeouts are retried, as retransmitting won't fix any other failure.
+// Each call should redo the whole exchange (e.g. including the challenge handshake) and discard late replies
+// belonging to the previous attempts.
+func Retry(ctx context.Context, req api.Request, exchange func(attempt int) error) error {
+	policy := api.RetryPolicy{}
+	if req.Retry != nil {
+		policy = *req.Retry
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(Backoff(policy, attempt))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+
+		err = exchange(attempt)
+		if err == nil || attempt+1 >= policy.Attempts || !errors.Is(err, api.ErrTimeout) || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// Returns the delay to wait before the given attempt (starting from 1 for the first retry).
+func Backoff(policy api.RetryPolicy, attempt int) time.Duration {
+	delay := float64(policy.Backoff)
+	if policy.Multiplier > 1 {
+		delay *= math.Pow(policy.Multiplier, float64(attempt-1))
+	}
+
+	if policy.MaxBackoff > 0 && delay > float64(policy.MaxBackoff) {
+		delay = float64(policy.MaxBackoff)
+	}
+
+	if policy.Jitter > 0 {
+		delay *= 1 + policy.Jitter*(rand.Float64()*2-1)
+	}
+
+	return time.Duration(delay)
+}
@@ -0,0 +1,14 @@
+package protocol
+
+// Established connection to the game server, which protocols use to exchange packets with it.
+// Send and Receive are bound by the query's timeout and context.
+type Transport interface {
+	Send(data []byte) error
+	Receive() (Packet, error)
+
+	GetHost() string // The host as requested (possibly a hostname), e.g. for protocols which send it to the server
+	GetIP() string   // The resolved IP
+	GetPort() uint16
+
+	Logger() Logger // The client's logger, for the protocol's diagnostic messages
+}
@@ -0,0 +1,110 @@
+package gamequery
+
+import (
+	"context"
+	"fmt"
+	"github.com/wisp-gg/gamequery/api"
+	"github.com/wisp-gg/gamequery/protocol"
+	"net"
+	"strings"
+)
+
+// Resolves the game servers' hostnames, *net.Resolver satisfies this interface.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// Address of the game server a protocol queries.
+type queryTarget struct {
+	Host    string // The host as requested, kept for protocols which send it to the server (e.g. Minecraft's handshake)
+	IP      string
+	Port    uint16
+	Network string // Address family of the IP, either "ip4" or "ip6"
+}
+
+func ipNetwork(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ip4"
+	}
+
+	return "ip6"
+}
+
+// Resolves the request's host and port for the protocol. Without an explicit port, the SRV record
+// of protocols implementing protocol.SRVProtocol is tried before falling back to the default port.
+//
+// Returns the first address of each allowed address family (in the resolver's order), with the second
+// one being the fallback for the happy eyeballs style racing.
+func (c *Client) resolve(ctx context.Context, req api.Request, queryProtocol protocol.Protocol) ([]queryTarget, error) {
+	switch req.Network {
+	case "", "ip", "ip4", "ip6":
+	default:
+		return nil, fmt.Errorf("unknown network %q", req.Network)
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(req.IP, "["), "]")
+	port := req.Port
+
+	lookupHost := host
+	if port == 0 {
+		port = queryProtocol.DefaultPort()
+
+		srvProtocol, ok := queryProtocol.(protocol.SRVProtocol)
+		if ok && net.ParseIP(host) == nil {
+			service, proto := srvProtocol.SRVService()
+
+			_, records, err := c.resolver.LookupSRV(ctx, service, proto, host)
+			if err == nil && len(records) > 0 {
+				lookupHost = strings.TrimSuffix(records[0].Target, ".")
+				port = records[0].Port
+
+				c.logger.Debug("gamequery: resolved SRV record", "protocol", queryProtocol.Name(), "host", host, "target", lookupHost, "port", port)
+			} else if err != nil {
+				c.logger.Debug("gamequery: SRV lookup failed", "protocol", queryProtocol.Name(), "host", host, "error", err)
+			}
+		}
+	}
+
+	var addrs []net.IPAddr
+	if ip := net.ParseIP(lookupHost); ip != nil {
+		addrs = []net.IPAddr{{IP: ip}}
+	} else {
+		var err error
+		addrs, err = c.resolver.LookupIPAddr(ctx, lookupHost)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	targets := make([]queryTarget, 0, 2)
+	for _, addr := range addrs {
+		network := ipNetwork(addr.IP)
+		if req.Network == "ip4" || req.Network == "ip6" {
+			if network != req.Network {
+				continue
+			}
+		}
+
+		if len(targets) > 0 && targets[0].Network == network {
+			continue
+		}
+
+		targets = append(targets, queryTarget{
+			Host:    host,
+			IP:      addr.String(),
+			Port:    port,
+			Network: network,
+		})
+
+		if len(targets) == 2 {
+			break
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no %s address found for %s", req.Network, lookupHost)
+	}
+
+	return targets, nil
+}
@@ -0,0 +1,469 @@
+// Package socks5 implements a SOCKS5 (RFC 1928) dialer, supporting CONNECT for TCP protocols and
+// UDP ASSOCIATE for UDP protocols, meant to be used with `gamequery.WithDialer`.
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/wisp-gg/gamequery/api"
+	"github.com/wisp-gg/gamequery/protocol"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	version = 0x05
+
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xFF
+
+	commandConnect      = 0x01
+	commandUDPAssociate = 0x03
+
+	addrTypeIPv4   = 0x01
+	addrTypeDomain = 0x03
+	addrTypeIPv6   = 0x04
+
+	replySucceeded         = 0x00
+	replyConnectionRefused = 0x05
+
+	udpReadBufSize = 65535
+)
+
+var replyMessages = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// Username/password authentication (RFC 1929) for the proxy.
+type Auth struct {
+	Username string
+	Password string
+}
+
+// Dials the connections through a SOCKS5 proxy.
+type Dialer struct {
+	ProxyAddress string          // The proxy's address (host:port)
+	Auth         *Auth           // Optional authentication, nil if the proxy doesn't require it
+	Forward      protocol.Dialer // Dials the proxy itself, defaults to a plain *net.Dialer
+}
+
+// Creates a new dialer for the proxy at the given address, auth being optional.
+func New(proxyAddress string, auth *Auth) *Dialer {
+	return &Dialer{
+		ProxyAddress: proxyAddress,
+		Auth:         auth,
+	}
+}
+
+// Connects to the address through the proxy, using CONNECT for "tcp" networks and UDP ASSOCIATE for "udp" ones.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return d.dialTCP(ctx, address)
+	case "udp", "udp4", "udp6":
+		return d.dialUDP(ctx, network, address)
+	}
+
+	return nil, fmt.Errorf("socks5: unsupported network %q", network)
+}
+
+func (d *Dialer) dialTCP(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = d.handshake(ctx, conn, commandConnect, address)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (d *Dialer) dialUDP(ctx context.Context, network, address string) (net.Conn, error) {
+	remoteAddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	control, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The client's address isn't known upfront (e.g. behind NAT), so an unspecified one is requested.
+	relayAddr, err := d.handshake(ctx, control, commandUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		_ = control.Close()
+		return nil, err
+	}
+
+	// Proxies commonly answer with an unspecified relay address, meaning the proxy's own address.
+	if relayAddr.IP.IsUnspecified() {
+		relayAddr.IP, err = d.proxyIP(ctx, control)
+		if err != nil {
+			_ = control.Close()
+			return nil, err
+		}
+	}
+
+	relay, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: relayAddr.IP, Port: relayAddr.Port, Zone: relayAddr.Zone})
+	if err != nil {
+		_ = control.Close()
+		return nil, err
+	}
+
+	return &udpConn{
+		UDPConn:    relay,
+		control:    control,
+		remoteAddr: remoteAddr,
+		header:     udpHeader(remoteAddr),
+	}, nil
+}
+
+func (d *Dialer) connect(ctx context.Context) (net.Conn, error) {
+	forward := d.Forward
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+
+	conn, err := forward.DialContext(ctx, "tcp", d.ProxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: connecting to the proxy: %w", err)
+	}
+
+	return conn, nil
+}
+
+// Returns the IP of the proxy the control connection is connected to. Connections from a custom Forward dialer
+// don't necessarily have an IP as their remote address, in which case the proxy's address is resolved instead.
+func (d *Dialer) proxyIP(ctx context.Context, control net.Conn) (net.IP, error) {
+	if host, _, err := net.SplitHostPort(control.RemoteAddr().String()); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			return ip, nil
+		}
+	}
+
+	host, _, err := net.SplitHostPort(d.ProxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid proxy address %q: %w", d.ProxyAddress, err)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: resolving the proxy's address: %w", err)
+	}
+
+	return addrs[0].IP, nil
+}
+
+// Negotiates the authentication and runs the command, returning the address the proxy bound for it.
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, command byte, address string) (*net.TCPAddr, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	// Unblocks the handshake once the context is done.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	bnd, err := d.negotiate(ctx, conn, command, address)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return bnd, err
+}
+
+func (d *Dialer) negotiate(ctx context.Context, conn net.Conn, command byte, address string) (*net.TCPAddr, error) {
+	methods := []byte{methodNoAuth}
+	if d.Auth != nil {
+		methods = []byte{methodNoAuth, methodUserPass}
+	}
+
+	greeting := append([]byte{version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+
+	if reply[0] != version {
+		return nil, fmt.Errorf("%w: socks5: unexpected proxy version %d", api.ErrMalformedResponse, reply[0])
+	}
+
+	switch reply[1] {
+	case methodNoAuth:
+	case methodUserPass:
+		if d.Auth == nil {
+			return nil, errors.New("socks5: proxy requires authentication")
+		}
+
+		if err := d.authenticate(conn); err != nil {
+			return nil, err
+		}
+	case methodNoAcceptable:
+		return nil, errors.New("socks5: proxy accepted none of the authentication methods")
+	default:
+		return nil, fmt.Errorf("socks5: proxy chose unsupported authentication method %d", reply[1])
+	}
+
+	addr, err := encodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	request := append([]byte{version, command, 0x00}, addr...)
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+
+	if header[0] != version {
+		return nil, fmt.Errorf("%w: socks5: unexpected proxy version %d", api.ErrMalformedResponse, header[0])
+	}
+
+	if header[1] != replySucceeded {
+		message, ok := replyMessages[header[1]]
+		if !ok {
+			message = "unknown error " + strconv.Itoa(int(header[1]))
+		}
+
+		if header[1] == replyConnectionRefused {
+			return nil, fmt.Errorf("%w: socks5: %s", api.ErrConnectionRefused, message)
+		}
+
+		return nil, errors.New("socks5: " + message)
+	}
+
+	return readAddress(ctx, conn)
+}
+
+func (d *Dialer) authenticate(conn net.Conn) error {
+	if len(d.Auth.Username) > 255 || len(d.Auth.Password) > 255 {
+		return errors.New("socks5: username or password is too long")
+	}
+
+	request := []byte{0x01, byte(len(d.Auth.Username))}
+	request = append(request, d.Auth.Username...)
+	request = append(request, byte(len(d.Auth.Password)))
+	request = append(request, d.Auth.Password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+
+	if reply[0] != 0x01 {
+		return fmt.Errorf("%w: socks5: unexpected authentication version %d", api.ErrMalformedResponse, reply[0])
+	}
+
+	if reply[1] != 0x00 {
+		return errors.New("socks5: proxy rejected the username or password")
+	}
+
+	return nil
+}
+
+// Encodes the address into the ATYP, DST.ADDR and DST.PORT fields.
+func encodeAddress(address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid port %q", portStr)
+	}
+
+	var encoded []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			encoded = append([]byte{addrTypeIPv4}, ip4...)
+		} else {
+			encoded = append([]byte{addrTypeIPv6}, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("socks5: hostname %q is too long", host)
+		}
+
+		encoded = append([]byte{addrTypeDomain, byte(len(host))}, host...)
+	}
+
+	return append(encoded, byte(port>>8), byte(port)), nil
+}
+
+// Reads the ATYP, BND.ADDR and BND.PORT fields, resolving domain addresses within the context.
+func readAddress(ctx context.Context, r io.Reader) (*net.TCPAddr, error) {
+	addrType := make([]byte, 1)
+	if _, err := io.ReadFull(r, addrType); err != nil {
+		return nil, err
+	}
+
+	var addrLen int
+	switch addrType[0] {
+	case addrTypeIPv4:
+		addrLen = net.IPv4len
+	case addrTypeIPv6:
+		addrLen = net.IPv6len
+	case addrTypeDomain:
+		domainLen := make([]byte, 1)
+		if _, err := io.ReadFull(r, domainLen); err != nil {
+			return nil, err
+		}
+		addrLen = int(domainLen[0])
+	default:
+		return nil, fmt.Errorf("%w: socks5: unknown address type %d", api.ErrMalformedResponse, addrType[0])
+	}
+
+	addr := make([]byte, addrLen+2)
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return nil, err
+	}
+
+	tcpAddr := &net.TCPAddr{
+		Port: int(binary.BigEndian.Uint16(addr[addrLen:])),
+	}
+	if addrType[0] == addrTypeDomain {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, string(addr[:addrLen]))
+		if err != nil {
+			return nil, fmt.Errorf("socks5: resolving the bound address: %w", err)
+		}
+		tcpAddr.IP = addrs[0].IP
+	} else {
+		tcpAddr.IP = net.IP(addr[:addrLen])
+	}
+
+	return tcpAddr, nil
+}
+
+// Header prepended to every datagram sent through the UDP relay: RSV, FRAG and the destination address.
+func udpHeader(remoteAddr *net.UDPAddr) []byte {
+	header := []byte{0x00, 0x00, 0x00}
+	if ip4 := remoteAddr.IP.To4(); ip4 != nil {
+		header = append(header, addrTypeIPv4)
+		header = append(header, ip4...)
+	} else {
+		header = append(header, addrTypeIPv6)
+		header = append(header, remoteAddr.IP.To16()...)
+	}
+
+	return append(header, byte(remoteAddr.Port>>8), byte(remoteAddr.Port))
+}
+
+// UDP connection relayed through the proxy, the association lasts as long as the control connection is open.
+type udpConn struct {
+	*net.UDPConn
+	control    net.Conn
+	remoteAddr *net.UDPAddr
+	header     []byte
+}
+
+func (conn *udpConn) Write(b []byte) (int, error) {
+	datagram := make([]byte, 0, len(conn.header)+len(b))
+	datagram = append(datagram, conn.header...)
+	datagram = append(datagram, b...)
+
+	if _, err := conn.UDPConn.Write(datagram); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Reads the next datagram relayed from the remote address, skipping fragmented ones and any sent by other hosts.
+func (conn *udpConn) Read(b []byte) (int, error) {
+	buf := make([]byte, udpReadBufSize)
+	for {
+		size, err := conn.UDPConn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+
+		payload, from, ok := parseUDPDatagram(buf[:size])
+		if !ok || !from.IP.Equal(conn.remoteAddr.IP) || from.Port != conn.remoteAddr.Port {
+			continue
+		}
+
+		// Like with a regular UDP socket, the part of the datagram not fitting into b is discarded.
+		return copy(b, payload), nil
+	}
+}
+
+func parseUDPDatagram(datagram []byte) ([]byte, *net.UDPAddr, bool) {
+	if len(datagram) < 4 || datagram[2] != 0x00 {
+		return nil, nil, false
+	}
+
+	var addrLen int
+	switch datagram[3] {
+	case addrTypeIPv4:
+		addrLen = net.IPv4len
+	case addrTypeIPv6:
+		addrLen = net.IPv6len
+	default:
+		return nil, nil, false
+	}
+
+	if len(datagram) < 4+addrLen+2 {
+		return nil, nil, false
+	}
+
+	from := &net.UDPAddr{
+		IP:   net.IP(datagram[4 : 4+addrLen]),
+		Port: int(binary.BigEndian.Uint16(datagram[4+addrLen:])),
+	}
+
+	return datagram[4+addrLen+2:], from, true
+}
+
+func (conn *udpConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func (conn *udpConn) Close() error {
+	err := conn.UDPConn.Close()
+	if controlErr := conn.control.Close(); err == nil {
+		err = controlErr
+	}
+
+	return err
+}
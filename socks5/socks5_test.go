@@ -0,0 +1,465 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/wisp-gg/gamequery/api"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Minimal in-process SOCKS5 proxy, supporting CONNECT and UDP ASSOCIATE to IPv4 targets.
+type testProxy struct {
+	listener net.Listener
+
+	auth        *Auth // Requires username/password authentication if set
+	authVersion byte  // Version to answer the authentication with, 0x01 if left out
+	reply       byte  // Reply code to answer the requests with
+	bindDomain  bool  // Answers CONNECT requests with a domain BND.ADDR
+	noise       bool  // Relays a fragmented datagram and one from another host before each UDP response
+}
+
+func newTestProxy(t *testing.T, configure func(proxy *testProxy)) *testProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	proxy := &testProxy{listener: listener}
+	if configure != nil {
+		configure(proxy)
+	}
+
+	go proxy.serve()
+
+	return proxy
+}
+
+func (p *testProxy) Address() string {
+	return p.listener.Addr().String()
+}
+
+func (p *testProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go p.handle(conn)
+	}
+}
+
+func (p *testProxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return
+	}
+
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	var method byte = methodNoAuth
+	if p.auth != nil {
+		method = methodUserPass
+	}
+
+	if !bytes.Contains(methods, []byte{method}) {
+		_, _ = conn.Write([]byte{version, methodNoAcceptable})
+		return
+	}
+	_, _ = conn.Write([]byte{version, method})
+
+	if p.auth != nil {
+		username, password, err := readCredentials(conn)
+		if err != nil {
+			return
+		}
+
+		authVersion := p.authVersion
+		if authVersion == 0 {
+			authVersion = 0x01
+		}
+
+		if username != p.auth.Username || password != p.auth.Password {
+			_, _ = conn.Write([]byte{authVersion, 0x01})
+			return
+		}
+		_, _ = conn.Write([]byte{authVersion, 0x00})
+	}
+
+	request := make([]byte, 10)
+	if _, err := io.ReadFull(conn, request); err != nil || request[3] != addrTypeIPv4 {
+		return
+	}
+
+	target := &net.TCPAddr{
+		IP:   net.IP(request[4:8]),
+		Port: int(binary.BigEndian.Uint16(request[8:10])),
+	}
+
+	if p.reply != replySucceeded {
+		_, _ = conn.Write([]byte{version, p.reply, 0x00, addrTypeIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	switch request[1] {
+	case commandConnect:
+		upstream, err := net.Dial("tcp", target.String())
+		if err != nil {
+			_, _ = conn.Write([]byte{version, replyConnectionRefused, 0x00, addrTypeIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+
+		bound := upstream.LocalAddr().(*net.TCPAddr)
+		reply := []byte{version, replySucceeded, 0x00}
+		if p.bindDomain {
+			reply = append(reply, addrTypeDomain, byte(len("localhost")))
+			reply = append(reply, "localhost"...)
+		} else {
+			reply = append(reply, addrTypeIPv4)
+			reply = append(reply, bound.IP.To4()...)
+		}
+		reply = append(reply, byte(bound.Port>>8), byte(bound.Port))
+		_, _ = conn.Write(reply)
+
+		go func() {
+			_, _ = io.Copy(upstream, conn)
+		}()
+		_, _ = io.Copy(conn, upstream)
+	case commandUDPAssociate:
+		relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+
+		// An unspecified relay address means the proxy's own address.
+		port := relay.LocalAddr().(*net.UDPAddr).Port
+		_, _ = conn.Write([]byte{version, replySucceeded, 0x00, addrTypeIPv4, 0, 0, 0, 0, byte(port >> 8), byte(port)})
+
+		go p.relay(relay)
+
+		// The association lasts as long as the control connection is open.
+		_, _ = io.Copy(io.Discard, conn)
+	}
+}
+
+func readCredentials(conn net.Conn) (string, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", err
+	}
+
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return "", "", err
+	}
+
+	passwordLen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, passwordLen); err != nil {
+		return "", "", err
+	}
+
+	password := make([]byte, passwordLen[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", "", err
+	}
+
+	return string(username), string(password), nil
+}
+
+func (p *testProxy) relay(relay net.PacketConn) {
+	buf := make([]byte, udpReadBufSize)
+	for {
+		size, client, err := relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		if size < 10 || buf[3] != addrTypeIPv4 {
+			continue
+		}
+
+		header := append([]byte{}, buf[:10]...)
+		payload := append([]byte{}, buf[10:size]...)
+		go p.forward(relay, client, header, payload)
+	}
+}
+
+func (p *testProxy) forward(relay net.PacketConn, client net.Addr, header, payload []byte) {
+	target := &net.UDPAddr{
+		IP:   net.IP(header[4:8]),
+		Port: int(binary.BigEndian.Uint16(header[8:10])),
+	}
+
+	upstream, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	if _, err := upstream.Write(payload); err != nil {
+		return
+	}
+
+	_ = upstream.SetReadDeadline(time.Now().Add(time.Second))
+	response := make([]byte, udpReadBufSize)
+	size, err := upstream.Read(response)
+	if err != nil {
+		return
+	}
+
+	if p.noise {
+		fragmented := append([]byte{}, header...)
+		fragmented[2] = 0x01
+		_, _ = relay.WriteTo(append(fragmented, "fragment"...), client)
+
+		otherHost := append([]byte{}, header...)
+		binary.BigEndian.PutUint16(otherHost[8:10], uint16(target.Port+1))
+		_, _ = relay.WriteTo(append(otherHost, "other host"...), client)
+	}
+
+	_, _ = relay.WriteTo(append(header, response[:size]...), client)
+}
+
+func tcpEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func udpEchoServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, udpReadBufSize)
+		for {
+			size, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			_, _ = conn.WriteTo(buf[:size], addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	return ctx
+}
+
+func echo(t *testing.T, conn net.Conn, message string) {
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	buf := make([]byte, 64)
+	size, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	if string(buf[:size]) != message {
+		t.Fatalf("got %q, want %q", buf[:size], message)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(proxy *testProxy)
+		auth      *Auth
+		wantErr   string
+	}{
+		{name: "no auth"},
+		{name: "no auth offered with credentials", auth: &Auth{Username: "user", Password: "pass"}},
+		{
+			name:      "user/pass",
+			configure: func(proxy *testProxy) { proxy.auth = &Auth{Username: "user", Password: "pass"} },
+			auth:      &Auth{Username: "user", Password: "pass"},
+		},
+		{
+			name:      "wrong password",
+			configure: func(proxy *testProxy) { proxy.auth = &Auth{Username: "user", Password: "pass"} },
+			auth:      &Auth{Username: "user", Password: "wrong"},
+			wantErr:   "rejected the username or password",
+		},
+		{
+			name: "wrong authentication version",
+			configure: func(proxy *testProxy) {
+				proxy.auth = &Auth{Username: "user", Password: "pass"}
+				proxy.authVersion = version
+			},
+			auth:    &Auth{Username: "user", Password: "pass"},
+			wantErr: "unexpected authentication version 5",
+		},
+		{
+			name:      "auth required without credentials",
+			configure: func(proxy *testProxy) { proxy.auth = &Auth{Username: "user", Password: "pass"} },
+			wantErr:   "accepted none of the authentication methods",
+		},
+		{
+			name:      "domain bound address",
+			configure: func(proxy *testProxy) { proxy.bindDomain = true },
+		},
+		{
+			name:      "failure reply",
+			configure: func(proxy *testProxy) { proxy.reply = 0x02 },
+			wantErr:   "connection not allowed by ruleset",
+		},
+	}
+
+	target := tcpEchoServer(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := newTestProxy(t, test.configure)
+
+			conn, err := New(proxy.Address(), test.auth).DialContext(testContext(t), "tcp", target)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			echo(t, conn, "hello")
+		})
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	proxy := newTestProxy(t, func(proxy *testProxy) { proxy.reply = replyConnectionRefused })
+
+	_, err := New(proxy.Address(), nil).DialContext(testContext(t), "tcp", "127.0.0.1:1")
+	if !errors.Is(err, api.ErrConnectionRefused) {
+		t.Fatalf("got error %v, want ErrConnectionRefused", err)
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	target := udpEchoServer(t)
+	for _, noise := range []bool{false, true} {
+		proxy := newTestProxy(t, func(proxy *testProxy) { proxy.noise = noise })
+
+		conn, err := New(proxy.Address(), nil).DialContext(testContext(t), "udp", target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if conn.RemoteAddr().String() != target {
+			t.Errorf("got remote address %s, want %s", conn.RemoteAddr(), target)
+		}
+
+		echo(t, conn, "ping")
+		echo(t, conn, "pong")
+		_ = conn.Close()
+	}
+}
+
+// Conn of a custom Forward dialer (e.g. a chained proxy), whose remote address isn't an IP.
+type wrappedConn struct {
+	net.Conn
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func (wrappedConn) RemoteAddr() net.Addr {
+	return pipeAddr{}
+}
+
+type wrappingDialer struct{}
+
+func (wrappingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return wrappedConn{conn}, nil
+}
+
+func TestUDPAssociateCustomForward(t *testing.T) {
+	proxy := newTestProxy(t, nil)
+	dialer := New(proxy.Address(), nil)
+	dialer.Forward = wrappingDialer{}
+
+	conn, err := dialer.DialContext(testContext(t), "udp", udpEchoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	echo(t, conn, "ping")
+}
+
+func TestUDPDatagram(t *testing.T) {
+	remoteAddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 27015}
+	header := udpHeader(remoteAddr)
+	if want := []byte{0x00, 0x00, 0x00, addrTypeIPv4, 192, 0, 2, 1, 0x69, 0x87}; !bytes.Equal(header, want) {
+		t.Fatalf("got header %v, want %v", header, want)
+	}
+
+	payload, from, ok := parseUDPDatagram(append(header, "data"...))
+	if !ok || string(payload) != "data" || !from.IP.Equal(remoteAddr.IP) || from.Port != remoteAddr.Port {
+		t.Fatalf("got %q from %v (%t)", payload, from, ok)
+	}
+
+	fragmented := append([]byte{}, header...)
+	fragmented[2] = 0x01
+	if _, _, ok := parseUDPDatagram(append(fragmented, "data"...)); ok {
+		t.Fatal("fragmented datagram wasn't skipped")
+	}
+
+	if _, _, ok := parseUDPDatagram(header[:6]); ok {
+		t.Fatal("truncated datagram wasn't skipped")
+	}
+}